@@ -1,3 +1,10 @@
 module go-mcp-local-filesystem
 
 go 1.24.4
+
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -1,14 +1,52 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
 )
 
 // MCP Protocol Message Types
@@ -22,6 +60,20 @@ type JSONRPCMessage struct {
 	Error   *RPCError   `json:"error,omitempty"`
 }
 
+// MarshalJSON keeps the id on error responses even when it is nil: JSON-RPC
+// requires "id": null when the request id could not be determined.
+func (m JSONRPCMessage) MarshalJSON() ([]byte, error) {
+	type message JSONRPCMessage
+	if m.Error == nil {
+		return json.Marshal(message(m))
+	}
+	return json.Marshal(struct {
+		JSONRPC string      `json:"jsonrpc"`
+		ID      interface{} `json:"id"`
+		Error   *RPCError   `json:"error"`
+	}{m.JSONRPC, m.ID, m.Error})
+}
+
 type RPCError struct {
 	Code    int         `json:"code"`
 	Message string      `json:"message"`
@@ -60,8 +112,11 @@ type InitializeResult struct {
 type ServerCapabilities struct {
 	Resources *ResourcesCapability `json:"resources,omitempty"`
 	Tools     *ToolsCapability     `json:"tools,omitempty"`
+	Logging   *LoggingCapability   `json:"logging,omitempty"`
 }
 
+type LoggingCapability struct{}
+
 type ResourcesCapability struct {
 	Subscribe   bool `json:"subscribe,omitempty"`
 	ListChanged bool `json:"listChanged,omitempty"`
@@ -88,8 +143,26 @@ type Resource struct {
 	Meta        map[string]interface{} `json:"meta,omitempty"`
 }
 
+type ListResourceTemplatesResult struct {
+	ResourceTemplates []ResourceTemplate `json:"resourceTemplates"`
+}
+
+// ResourceTemplate is an RFC 6570 URI template clients can expand into
+// resource URIs.
+type ResourceTemplate struct {
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
 type ReadResourceParams struct {
-	URI string `json:"uri"`
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	// IfNoneMatch is an etag from an earlier read; when the file still has
+	// it, the result carries no content.
+	IfNoneMatch string `json:"if_none_match,omitempty"`
 }
 
 type ReadResourceResult struct {
@@ -97,14 +170,42 @@ type ReadResourceResult struct {
 }
 
 type ResourceContent struct {
-	URI      string `json:"uri"`
-	MimeType string `json:"mimeType,omitempty"`
-	Text     string `json:"text,omitempty"`
-	Blob     string `json:"blob,omitempty"`
+	URI      string                 `json:"uri"`
+	MimeType string                 `json:"mimeType,omitempty"`
+	Text     string                 `json:"text,omitempty"`
+	Blob     string                 `json:"blob,omitempty"`
+	Meta     map[string]interface{} `json:"meta,omitempty"`
+}
+
+type SubscribeParams struct {
+	URI string `json:"uri"`
+	// Tail makes updates carry the bytes appended since the last one, like
+	// tail -f.
+	Tail bool `json:"tail,omitempty"`
+}
+
+type SetLevelParams struct {
+	Level string `json:"level"`
+}
+
+type LogMessageParams struct {
+	Level  string                 `json:"level"`
+	Logger string                 `json:"logger,omitempty"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+type CancelledParams struct {
+	RequestID interface{} `json:"requestId"`
+	Reason    string      `json:"reason,omitempty"`
+}
+
+type ListToolsParams struct {
+	Cursor string `json:"cursor,omitempty"`
 }
 
 type ListToolsResult struct {
-	Tools []Tool `json:"tools"`
+	Tools      []Tool `json:"tools"`
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 type Tool struct {
@@ -119,26 +220,216 @@ type CallToolParams struct {
 }
 
 type CallToolResult struct {
-	Content []ToolContent `json:"content"`
-	IsError bool          `json:"isError,omitempty"`
+	Content []ToolContent          `json:"content"`
+	IsError bool                   `json:"isError,omitempty"`
+	Meta    map[string]interface{} `json:"meta,omitempty"`
 }
 
 type ToolContent struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type     string           `json:"type"`
+	Text     string           `json:"text"`
+	Resource *ResourceContent `json:"resource,omitempty"`
 }
 
 // MCP Server Implementation
 
+// defaultMaxFileSize caps how much content a single read may return.
+const defaultMaxFileSize = 10 << 20
+
+// defaultMaxMessageSize is the largest incoming JSON-RPC message accepted by
+// default; maxHeaderBlockSize bounds a Content-Length header block.
+const (
+	defaultMaxMessageSize = 4 << 20
+	maxHeaderBlockSize    = 4 << 10
+)
+
+// serverName and serverVersion identify the server in initialize results
+// and -version output.
+const (
+	serverName    = "file-server"
+	serverVersion = "1.0.0"
+)
+
+// dryRunPrefix starts every result of a mutating tool in -dry-run mode.
+const dryRunPrefix = "Dry run: would "
+
+// readOnlyMessage is the tool error returned by mutating tools in read-only mode.
+const readOnlyMessage = "Server is in read-only mode: modifications are disabled"
+
+// baseDirCheckInterval is how often the served directory is re-checked when
+// -require-dir is set.
+const baseDirCheckInterval = 5 * time.Second
+
+// Root is one served directory. With several roots, clients address files as
+// "<name>/<path>" and resource names carry the same prefix.
+type Root struct {
+	Name string
+	Dir  string
+}
+
 type MCPServer struct {
-	baseDir string
-	scanner *bufio.Scanner
+	// roots are the served directories, with absolute Dir paths. baseDir is
+	// the first root, which unqualified paths are resolved against.
+	roots       []Root
+	baseDir     string
+	maxFileSize int64
+
+	// files is where the tools read and write; osFileService outside of
+	// tests.
+	files FileService
+
+	// toolsPageSize is how many tools one tools/list page holds.
+	toolsPageSize int
+
+	// maxSearchResults is the default and largest max_results of
+	// search_files.
+	maxSearchResults int
+
+	// enabledTools, when set, is the only tools offered; disabledTools are
+	// withheld on top of that. See toolEnabled.
+	enabledTools  map[string]bool
+	disabledTools map[string]bool
+
+	// baseURL, when set, replaces file:// in resource URIs; see
+	// resourceURI. It always ends in a slash.
+	baseURL string
+
+	// toolTimeout bounds how long one tools/call may run; zero means no
+	// limit.
+	toolTimeout time.Duration
+
+	// requireDir makes every request fail fast with a clear error while the
+	// served directory is missing; createDir tries to recreate it instead.
+	requireDir       bool
+	createDir        bool
+	baseDirAvailable atomic.Bool
+
+	// auditLogPath, when set, is the absolute path of a JSON lines file that
+	// records every file read. clientInfo is captured at initialize for it.
+	auditLogPath string
+	auditMu      sync.Mutex
+	clientInfo   *ClientInfo
+
+	// allowControl enables operator-only methods such as server/restart.
+	allowControl bool
+
+	// configPath is the -config file, read again by server/restart.
+	// flagSettings and setFlags are what the command line gave, so the file
+	// can be applied on top of them as at startup.
+	configPath   string
+	flagSettings settings
+	setFlags     map[string]bool
+
+	// startTime and the counters below are reported by server/stats unless
+	// noStats turns the method off. bytesRead counts the file content that
+	// recordAudit sees, whether or not the audit log is on.
+	noStats         bool
+	startTime       time.Time
+	requestsHandled atomic.Int64
+	bytesRead       atomic.Int64
+
+	// readOnly rejects every tool that would modify the filesystem.
+	readOnly bool
+
+	// dryRun makes mutating tools report what they would do instead of
+	// doing it.
+	dryRun bool
+
+	// noFollowSymlinks refuses every path that goes through a symlink, not
+	// just the ones that lead outside the served roots.
+	noFollowSymlinks bool
+
+	// followSymlinks makes tree walks descend into symlinked directories;
+	// see walkDir.
+	followSymlinks bool
+
+	// respectGitignore hides paths excluded by .gitignore files from
+	// resources/list and the search tools.
+	respectGitignore bool
+
+	// mimeOverrides maps lower-case extensions to MIME types from -mime-type
+	// and the config file; they win over the built-in table.
+	mimeOverrides map[string]string
+
+	// includeGlobs and excludeGlobs restrict which files are served; a file
+	// must match an include (when any are set) and no exclude. They are
+	// compiled by parseGlobList.
+	includeGlobs []*regexp.Regexp
+	excludeGlobs []*regexp.Regexp
+
+	// framing selects how outgoing messages are delimited: framingLine writes
+	// one JSON object per line, framingHeader prefixes a Content-Length header.
+	// Incoming framing is detected per message regardless of this setting.
+	framing string
+
+	// maxMessageSize is the largest incoming message accepted; longer ones
+	// are discarded and answered with an Invalid Request error.
+	maxMessageSize int
+
+	// writeMu serializes writes to out, which happen from the request loop,
+	// the file watcher and the logger. Each message is flushed whole.
+	writeMu sync.Mutex
+	out     *bufio.Writer
+
+	// httpMode routes outgoing messages to HTTP instead of stdout: replies
+	// collects the responses for each POST being dispatched by request id
+	// (guarded by writeMu, with dispatchMu running one request at a time
+	// apart from detached ones), and notifications are broadcast to the open
+	// event streams in sseClients.
+	httpMode   bool
+	dispatchMu sync.Mutex
+	replies    map[string]*[][]byte
+	sseMu      sync.Mutex
+	sseClients map[chan []byte]struct{}
+
+	// watcher reports filesystem changes under the base directory.
+	// subscriptions maps absolute paths to what a client subscribed with;
+	// pendingUpdates and listChangedTimer debounce bursts of events.
+	subsMu           sync.Mutex
+	watcher          *fsnotify.Watcher
+	subscriptions    map[string]*subscription
+	pendingUpdates   map[string]*time.Timer
+	listChangedTimer *time.Timer
+
+	// fileLocks holds a lock for each file being written, so that a check
+	// and the write that depends on it (write_if_unchanged's hash, edit_file's
+	// read) are not interleaved with another write through this server.
+	fileLocksMu sync.Mutex
+	fileLocks   map[string]*fileLock
+
+	// inflight maps each request being handled, or queued, to its context
+	// so notifications/cancelled can cancel it. Keys come from requestKey.
+	inflightMu sync.Mutex
+	inflight   map[string]*inflightRequest
+
+	// clientLogLevel is the level the client chose with logging/setLevel;
+	// nothing is forwarded as notifications/message until it does.
+	clientLogEnabled atomic.Bool
+	clientLogLevel   slog.LevelVar
 }
 
-func NewMCPServer(baseDir string) *MCPServer {
+const (
+	framingLine   = "line"
+	framingHeader = "header"
+)
+
+func NewMCPServer(roots []Root) *MCPServer {
 	return &MCPServer{
-		baseDir: baseDir,
-		scanner: bufio.NewScanner(os.Stdin),
+		roots:            roots,
+		baseDir:          roots[0].Dir,
+		files:            osFileService{},
+		maxFileSize:      defaultMaxFileSize,
+		toolsPageSize:    defaultToolsPageSize,
+		maxSearchResults: defaultMaxResults,
+		framing:          framingLine,
+		maxMessageSize:   defaultMaxMessageSize,
+		subscriptions:    make(map[string]*subscription),
+		pendingUpdates:   make(map[string]*time.Timer),
+		sseClients:       make(map[chan []byte]struct{}),
+		replies:          make(map[string]*[][]byte),
+		inflight:         make(map[string]*inflightRequest),
+		out:              bufio.NewWriter(io.Discard),
+		startTime:        time.Now(),
 	}
 }
 
@@ -148,10 +439,51 @@ func (s *MCPServer) sendMessage(msg JSONRPCMessage) error {
 		return err
 	}
 
-	fmt.Println(string(data))
-	return nil
+	// A cancelled request gets no response at all.
+	if msg.Method == "" && msg.ID != nil && s.isCancelledRequest(msg.ID) {
+		slog.Debug("Dropping response to cancelled request", "id", msg.ID)
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.httpMode {
+		// Responses belong to the POST being dispatched; notifications go
+		// to every open event stream.
+		if replies := s.replies[requestKey(msg.ID)]; msg.Method == "" && replies != nil {
+			*replies = append(*replies, data)
+		} else {
+			s.broadcastEvent(data)
+		}
+		return nil
+	}
+
+	if s.framing == framingHeader {
+		fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(data))
+		s.out.Write(data)
+	} else {
+		s.out.Write(data)
+		s.out.WriteByte('\n')
+	}
+	return s.out.Flush()
+}
+
+func (s *MCPServer) sendNotification(method string, params interface{}) error {
+	msg := JSONRPCMessage{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	}
+	return s.sendMessage(msg)
 }
 
+// sendError answers a request with a JSON-RPC error. Tools use it, with
+// -32602, when the call itself is at fault: a missing or malformed argument,
+// or a path the server will not touch (outside the roots, reserved,
+// filtered). What the filesystem says about an acceptable path, such as a
+// missing file or an OS permission error, is a tool result with isError set;
+// see sendToolResult.
 func (s *MCPServer) sendError(id interface{}, code int, message string) error {
 	msg := JSONRPCMessage{
 		JSONRPC: "2.0",
@@ -173,6 +505,11 @@ func (s *MCPServer) sendResult(id interface{}, result interface{}) error {
 	return s.sendMessage(msg)
 }
 
+// sendDryRun reports what a mutating tool would have done in -dry-run mode.
+func (s *MCPServer) sendDryRun(id interface{}, format string, args ...interface{}) error {
+	return s.sendToolResult(id, dryRunPrefix+fmt.Sprintf(format, args...), false)
+}
+
 func (s *MCPServer) sendToolResult(id interface{}, text string, isError bool) error {
 	result := CallToolResult{
 		Content: []ToolContent{
@@ -186,23 +523,47 @@ func (s *MCPServer) sendToolResult(id interface{}, text string, isError bool) er
 	return s.sendResult(id, result)
 }
 
+// supportedProtocolVersions lists the MCP protocol revisions the server
+// speaks, newest first.
+var supportedProtocolVersions = []string{"2025-03-26", "2024-11-05"}
+
+// negotiateProtocolVersion echoes the client's requested version when the
+// server supports it and otherwise offers the newest one it does.
+func negotiateProtocolVersion(requested string) string {
+	for _, v := range supportedProtocolVersions {
+		if v == requested {
+			return v
+		}
+	}
+	return supportedProtocolVersions[0]
+}
+
 func (s *MCPServer) handleInitialize(id interface{}, params InitializeParams) error {
-	log.Printf("Initialize request from client: %s %s", params.ClientInfo.Name, params.ClientInfo.Version)
+	slog.Info("Initialize request", "client", params.ClientInfo.Name, "version", params.ClientInfo.Version)
+
+	version := negotiateProtocolVersion(params.ProtocolVersion)
+	if version != params.ProtocolVersion {
+		slog.Warn("Unsupported protocol version requested", "requested", params.ProtocolVersion, "offered", version)
+	}
+
+	clientInfo := params.ClientInfo
+	s.clientInfo = &clientInfo
 
 	result := InitializeResult{
-		ProtocolVersion: "2024-11-05",
+		ProtocolVersion: version,
 		Capabilities: ServerCapabilities{
 			Resources: &ResourcesCapability{
-				Subscribe:   false,
-				ListChanged: false,
+				Subscribe:   true,
+				ListChanged: true,
 			},
 			Tools: &ToolsCapability{
 				ListChanged: false,
 			},
+			Logging: &LoggingCapability{},
 		},
 		ServerInfo: ServerInfo{
-			Name:    "file-server",
-			Version: "1.0.0",
+			Name:    serverName,
+			Version: serverVersion,
 		},
 	}
 
@@ -211,66 +572,128 @@ func (s *MCPServer) handleInitialize(id interface{}, params InitializeParams) er
 
 func (s *MCPServer) handleNotificationInitialized() {
 	// This is a notification, no response needed
-	log.Printf("Received initialized notification")
+	slog.Debug("Received initialized notification")
 }
 
-func (s *MCPServer) handleListResources(id interface{}) error {
-	log.Printf("Listing resources in directory: %s", s.baseDir)
-
+func (s *MCPServer) handleListResources(ctx context.Context, id interface{}) error {
 	var resources []Resource
+	progress := s.progressReporter(ctx)
+	scanned := 0
 
-	err := filepath.WalkDir(s.baseDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	for _, root := range s.roots {
+		slog.Debug("Listing resources", "dir", root.Dir)
 
-		if d.IsDir() {
-			return nil
-		}
+		ignore := s.newGitignoreMatcher(root.Dir)
 
-		relPath, err := filepath.Rel(s.baseDir, path)
-		if err != nil {
-			return err
-		}
+		err := s.walkDir(root.Dir, func(path string, d fs.DirEntry, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
 
-		uri := "file://" + filepath.Join(s.baseDir, relPath)
+			if skip, err := ignore.skip(path, d, root.Dir); skip {
+				return err
+			}
 
-		// Determine MIME type based on file extension
-		mimeType := getMimeType(filepath.Ext(path))
+			if d.IsDir() {
+				return nil
+			}
 
-		resource := Resource{
-			URI:         uri,
-			Name:        relPath,
-			Description: fmt.Sprintf("File: %s", relPath),
-			MimeType:    mimeType,
-		}
+			scanned++
+			progress.update(scanned)
 
-		resources = append(resources, resource)
-		return nil
-	})
+			if s.isReservedPath(path) || s.isFilteredOut(path, false) {
+				return nil
+			}
 
-	if err != nil {
-		log.Printf("Error walking directory: %v", err)
-		return s.sendError(id, -32603, fmt.Sprintf("Failed to list resources: %v", err))
+			// Names are relative to their root and prefixed with the root
+			// name when there are several, so they never collide.
+			relPath := s.relativePath(path)
+			uri := s.resourceURI(path)
+
+			// Determine MIME type based on file extension
+			mimeType := s.detectFileMimeType(path)
+
+			resource := Resource{
+				URI:         uri,
+				Name:        relPath,
+				Description: fmt.Sprintf("File: %s", relPath),
+				MimeType:    mimeType,
+			}
+
+			// The walk already holds the entry, so this costs no extra stat
+			// call except for symlinks, which describe their target.
+			info, err := d.Info()
+			if d.Type()&fs.ModeSymlink != 0 {
+				info, err = s.files.Stat(path)
+			}
+			if err == nil {
+				resource.Meta = map[string]interface{}{
+					"size":     info.Size(),
+					"modified": info.ModTime().UTC().Format(time.RFC3339),
+				}
+			}
+
+			resources = append(resources, resource)
+			return nil
+		})
+
+		if err != nil {
+			slog.Error("Failed to list resources", "dir", root.Dir, "error", err)
+			return s.sendError(id, -32603, fmt.Sprintf("Failed to list resources: %v", err))
+		}
 	}
 
 	result := ListResourcesResult{
 		Resources: resources,
 	}
 
-	log.Printf("Found %d resources", len(resources))
+	slog.Debug("Listed resources", "count", len(resources))
 	return s.sendResult(id, result)
 }
 
-func (s *MCPServer) handleReadResource(id interface{}, params ReadResourceParams) error {
-	log.Printf("Reading resource: %s", params.URI)
+// handleListResourceTemplates offers one template per root. {+path} is a
+// reserved expansion, so a relative path such as docs/a.md keeps its
+// slashes.
+func (s *MCPServer) handleListResourceTemplates(id interface{}) error {
+	templates := make([]ResourceTemplate, 0, len(s.roots))
+	for _, root := range s.roots {
+		// With -base-url the root's location on disk stays private.
+		where := root.Dir
+		if s.baseURL != "" {
+			where = "root " + root.Name
+		}
+		templates = append(templates, ResourceTemplate{
+			URITemplate: s.resourceURI(root.Dir) + "/{+path}",
+			Name:        root.Name,
+			Description: fmt.Sprintf("Any file under %s; path is relative to it", where),
+		})
+	}
+
+	return s.sendResult(id, ListResourceTemplatesResult{ResourceTemplates: templates})
+}
+
+func (s *MCPServer) handleReadResource(ctx context.Context, id interface{}, params ReadResourceParams) error {
+	slog.Debug("Reading resource", "uri", params.URI)
+
+	if params.MimeType != "" && !isValidMimeType(params.MimeType) {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid mimeType: %s", params.MimeType))
+	}
+	if params.Encoding != "" && params.Encoding != encodingGzip {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid encoding: %s (supported: %s)", params.Encoding, encodingGzip))
+	}
 
 	// Parse URI to get file path
-	if !strings.HasPrefix(params.URI, "file://") {
-		return s.sendError(id, -32602, "Invalid URI scheme, expected file://")
+	filePath, err := s.resourcePath(params.URI)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
 	}
 
-	filePath := strings.TrimPrefix(params.URI, "file://")
+	if err := checkPathChars(filePath); err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
 
 	// Security check: ensure the file is within the base directory
 	absPath, err := filepath.Abs(filePath)
@@ -278,394 +701,9500 @@ func (s *MCPServer) handleReadResource(id interface{}, params ReadResourceParams
 		return s.sendError(id, -32602, "Invalid file path")
 	}
 
-	absBaseDir, err := filepath.Abs(s.baseDir)
-	if err != nil {
-		return s.sendError(id, -32603, "Server configuration error")
+	if !s.withinRoots(absPath) || s.isReservedPath(absPath) {
+		return s.sendError(id, -32602, "Access denied: file outside allowed directory")
 	}
 
-	if !strings.HasPrefix(absPath, absBaseDir) {
-		return s.sendError(id, -32602, "Access denied: file outside allowed directory")
+	if s.isFilteredOut(absPath, false) {
+		return s.sendError(id, -32602, "Access denied: path is excluded by server filters")
+	}
+
+	if err := s.checkRealPath(absPath); err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	var variant []string
+	if params.MimeType != "" {
+		variant = append(variant, "mimeType="+params.MimeType)
+	}
+	if params.Encoding != "" {
+		variant = append(variant, "encoding="+params.Encoding)
+	}
+	var etag string
+	if info, err := s.files.Stat(absPath); err == nil {
+		if info.IsDir() {
+			return s.readDirectoryResource(ctx, id, params, absPath)
+		}
+		etag = fileETag(info, strings.Join(variant, ";"))
+	}
+	if etag != "" && params.IfNoneMatch == etag {
+		return s.sendResult(id, ReadResourceResult{
+			Contents: []ResourceContent{{
+				URI:  params.URI,
+				Meta: map[string]interface{}{"etag": etag, "notModified": true},
+			}},
+		})
 	}
 
 	// Read file content
-	content, err := os.ReadFile(absPath)
+	content, err := s.readFileLimited(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return s.sendError(id, -32602, "File not found")
 		}
+		var tooLarge *FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			return s.sendError(id, -32602, fmt.Sprintf("File too large: %d bytes exceeds limit of %d bytes; use the read_file tool with offset/limit or start_line/end_line to read part of it", tooLarge.Size, tooLarge.Limit))
+		}
 		return s.sendError(id, -32603, fmt.Sprintf("Failed to read file: %v", err))
 	}
 
-	mimeType := getMimeType(filepath.Ext(absPath))
+	mimeType := s.detectMimeType(filepath.Ext(absPath), content)
+	if params.MimeType != "" {
+		mimeType = params.MimeType
+	}
 
 	resourceContent := ResourceContent{
 		URI:      params.URI,
 		MimeType: mimeType,
-		Text:     string(content),
+	}
+
+	// Binary content would not survive as a JSON string, so it goes out as a
+	// base64 blob. An explicit override decides on its own.
+	binary := isBinaryContent(content)
+	if params.MimeType != "" {
+		binary = !isTextMimeType(params.MimeType)
+	}
+
+	if binary {
+		resourceContent.Blob = base64.StdEncoding.EncodeToString(content)
+	} else if blob, ok := gzipBase64IfSmaller(content, params.Encoding); ok {
+		resourceContent.Blob = blob
+		resourceContent.Meta = gzipMeta(len(content))
+	} else {
+		resourceContent.Text = string(content)
+	}
+	if etag != "" {
+		if resourceContent.Meta == nil {
+			resourceContent.Meta = make(map[string]interface{})
+		}
+		resourceContent.Meta["etag"] = etag
 	}
 
 	result := ReadResourceResult{
 		Contents: []ResourceContent{resourceContent},
 	}
 
-	log.Printf("Successfully read file: %s (%d bytes)", absPath, len(content))
+	s.recordAudit("resources/read", s.relativePath(absPath), params.URI, len(content))
+
+	slog.Info("Read resource", "path", absPath, "bytes", len(content))
 	return s.sendResult(id, result)
 }
 
-func (s *MCPServer) handleListTools(id interface{}) error {
-	log.Printf("Listing available tools")
+// readDirectoryResource answers resources/read on a directory with a JSON
+// array of its entries, each with the URI to read it by. A directory's mtime
+// does not follow changes to its files, so there is no etag.
+func (s *MCPServer) readDirectoryResource(ctx context.Context, id interface{}, params ReadResourceParams, absPath string) error {
+	count := 0
+	entries, err := s.listDirEntries(ctx, absPath, 1, 1, &count)
+	truncated := errors.Is(err, errListingTruncated)
+	if err != nil && !truncated {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.sendError(id, -32603, fmt.Sprintf("Failed to list directory: %v", err))
+	}
+	sortDirEntries(entries, "name", false, false)
+	for i := range entries {
+		entries[i].URI = s.resourceURI(filepath.Join(absPath, entries[i].Name))
+	}
 
-	tools := []Tool{
-		{
-			Name:        "read_file",
-			Description: "Read the contents of a file",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"path": map[string]interface{}{
-						"type":        "string",
-						"description": "The path to the file to read",
-					},
-				},
-				"required": []string{"path"},
-			},
-		},
-		{
-			Name:        "list_directory",
-			Description: "List files and directories in a given path",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"path": map[string]interface{}{
-						"type":        "string",
-						"description": "The path to the directory to list (optional, defaults to base directory)",
-					},
-				},
-				"required": []string{},
-			},
-		},
-		{
-			Name:        "search_files",
-			Description: "Search for files by name pattern",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"pattern": map[string]interface{}{
-						"type":        "string",
-						"description": "The filename pattern to search for (supports wildcards)",
-					},
-				},
-				"required": []string{"pattern"},
-			},
-		},
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return s.sendError(id, -32603, fmt.Sprintf("Failed to encode listing: %v", err))
 	}
 
-	result := ListToolsResult{
-		Tools: tools,
+	resourceContent := ResourceContent{
+		URI:      params.URI,
+		MimeType: "application/json",
+	}
+	if blob, ok := gzipBase64IfSmaller(data, params.Encoding); ok {
+		resourceContent.Blob = blob
+		resourceContent.Meta = gzipMeta(len(data))
+	} else {
+		resourceContent.Text = string(data)
+	}
+	if truncated {
+		if resourceContent.Meta == nil {
+			resourceContent.Meta = make(map[string]interface{})
+		}
+		resourceContent.Meta["truncated"] = true
 	}
 
-	log.Printf("Returning %d tools", len(tools))
-	return s.sendResult(id, result)
-}
+	s.recordAudit("resources/read", s.relativePath(absPath), params.URI, len(data))
 
-func (s *MCPServer) handleCallTool(id interface{}, params CallToolParams) error {
-	log.Printf("Calling tool: %s with arguments: %v", params.Name, params.Arguments)
+	slog.Info("Read directory resource", "path", absPath, "entries", len(entries), "truncated", truncated)
+	return s.sendResult(id, ReadResourceResult{Contents: []ResourceContent{resourceContent}})
+}
 
-	switch params.Name {
-	case "read_file":
-		return s.handleReadFileTool(id, params.Arguments)
-	case "list_directory":
-		return s.handleListDirectoryTool(id, params.Arguments)
-	case "search_files":
-		return s.handleSearchFilesTool(id, params.Arguments)
-	default:
-		return s.sendError(id, -32601, fmt.Sprintf("Tool not found: %s", params.Name))
+func (s *MCPServer) handleSubscribe(id interface{}, params SubscribeParams, subscribe bool) error {
+	filePath, err := s.resourcePath(params.URI)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
 	}
-}
 
-func (s *MCPServer) handleReadFileTool(id interface{}, args map[string]interface{}) error {
-	pathArg, ok := args["path"]
-	if !ok {
-		return s.sendError(id, -32602, "Missing required argument: path")
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return s.sendError(id, -32602, "Invalid file path")
 	}
 
-	path, ok := pathArg.(string)
-	if !ok {
-		return s.sendError(id, -32602, "Invalid path argument: must be string")
+	if !s.withinRoots(absPath) || s.isReservedPath(absPath) {
+		return s.sendError(id, -32602, "Access denied: file outside allowed directory")
 	}
 
-	// Security check: ensure the file is within the base directory
-	fullPath := filepath.Join(s.baseDir, path)
-	absPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return s.sendError(id, -32602, "Invalid file path")
+	if s.isFilteredOut(absPath, false) {
+		return s.sendError(id, -32602, "Access denied: path is excluded by server filters")
 	}
 
-	absBaseDir, err := filepath.Abs(s.baseDir)
-	if err != nil {
-		return s.sendError(id, -32603, "Server configuration error")
+	if !subscribe {
+		s.subsMu.Lock()
+		delete(s.subscriptions, absPath)
+		s.subsMu.Unlock()
+		slog.Info("Unsubscribed from resource", "uri", params.URI)
+		return s.sendResult(id, struct{}{})
 	}
 
-	if !strings.HasPrefix(absPath, absBaseDir) {
-		return s.sendError(id, -32602, "Access denied: file outside allowed directory")
+	// Tail updates carry content, so the same checks as resources/read apply.
+	if err := checkPathChars(absPath); err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if err := s.checkRealPath(absPath); err != nil {
+		return s.sendError(id, -32602, err.Error())
 	}
 
-	// Read file content
-	content, err := os.ReadFile(absPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+	sub := &subscription{uri: params.URI, tail: params.Tail}
+	if sub.tail {
+		// Only what is written from now on is sent.
+		if info, err := s.files.Stat(absPath); err == nil && !info.IsDir() {
+			sub.offset, sub.file = info.Size(), info
 		}
-		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
 	}
 
-	result := fmt.Sprintf("Contents of %s:\n%s", path, string(content))
-	return s.sendToolResult(id, result, false)
+	s.subsMu.Lock()
+	if s.watcher == nil {
+		s.subsMu.Unlock()
+		return s.sendError(id, -32603, "File watching is unavailable")
+	}
+	s.subscriptions[absPath] = sub
+	s.subsMu.Unlock()
+
+	slog.Info("Subscribed to resource", "uri", params.URI, "tail", params.Tail)
+	return s.sendResult(id, struct{}{})
 }
 
-func (s *MCPServer) handleListDirectoryTool(id interface{}, args map[string]interface{}) error {
-	var targetDir string
+// progressTokenKey is the context key for a request's _meta.progressToken.
+type progressTokenKey struct{}
 
-	if pathArg, ok := args["path"]; ok {
-		if path, ok := pathArg.(string); ok {
-			targetDir = filepath.Join(s.baseDir, path)
-		} else {
-			return s.sendError(id, -32602, "Invalid path argument: must be string")
-		}
-	} else {
-		targetDir = s.baseDir
+func progressTokenFromParams(params interface{}) interface{} {
+	var meta struct {
+		Meta struct {
+			ProgressToken interface{} `json:"progressToken"`
+		} `json:"_meta"`
 	}
-
-	// Security check
-	absPath, err := filepath.Abs(targetDir)
-	if err != nil {
-		return s.sendError(id, -32602, "Invalid directory path")
+	if err := json.Unmarshal(mustMarshal(params), &meta); err != nil {
+		return nil
 	}
+	return meta.Meta.ProgressToken
+}
 
-	absBaseDir, err := filepath.Abs(s.baseDir)
-	if err != nil {
-		return s.sendError(id, -32603, "Server configuration error")
-	}
+// progressInterval caps how often notifications/progress is sent for one
+// request.
+const progressInterval = 100 * time.Millisecond
 
-	if !strings.HasPrefix(absPath, absBaseDir) {
-		return s.sendError(id, -32602, "Access denied: directory outside allowed path")
+type ProgressParams struct {
+	ProgressToken interface{} `json:"progressToken"`
+	Progress      int         `json:"progress"`
+	Message       string      `json:"message,omitempty"`
+}
+
+// progressReporter sends notifications/progress for a request that asked
+// for it. A nil reporter, for requests without a token, does nothing.
+type progressReporter struct {
+	s     *MCPServer
+	token interface{}
+	last  time.Time
+}
+
+func (s *MCPServer) progressReporter(ctx context.Context) *progressReporter {
+	token := ctx.Value(progressTokenKey{})
+	if token == nil {
+		return nil
+	}
+	return &progressReporter{s: s, token: token, last: time.Now()}
+}
+
+// update reports that progress files have been scanned, unless an update
+// went out less than progressInterval ago.
+func (p *progressReporter) update(progress int) {
+	if p == nil || time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	p.s.sendNotification("notifications/progress", ProgressParams{
+		ProgressToken: p.token,
+		Progress:      progress,
+		Message:       fmt.Sprintf("Scanned %d files", progress),
+	})
+}
+
+type inflightRequest struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// requestKey identifies a request ID in the inflight map; encoding it keeps
+// the number 1 and the string "1" apart.
+func requestKey(id interface{}) string {
+	data, _ := json.Marshal(id)
+	return string(data)
+}
+
+// beginRequest derives the context a request is handled with and registers
+// it for cancellation. The returned function must be called once the request
+// is finished.
+func (s *MCPServer) beginRequest(parent context.Context, id interface{}) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if id == nil {
+		return ctx, cancel
+	}
+
+	key := requestKey(id)
+	req := &inflightRequest{ctx: ctx, cancel: cancel}
+	s.inflightMu.Lock()
+	s.inflight[key] = req
+	s.inflightMu.Unlock()
+
+	return ctx, func() {
+		s.inflightMu.Lock()
+		if s.inflight[key] == req {
+			delete(s.inflight, key)
+		}
+		s.inflightMu.Unlock()
+		cancel()
+	}
+}
+
+func (s *MCPServer) isCancelledRequest(id interface{}) bool {
+	s.inflightMu.Lock()
+	req := s.inflight[requestKey(id)]
+	s.inflightMu.Unlock()
+	return req != nil && req.ctx.Err() != nil
+}
+
+// handleCancelled cancels an in-flight request. Unknown IDs are ignored, as
+// the request may already have finished.
+func (s *MCPServer) handleCancelled(rawParams interface{}) {
+	var params CancelledParams
+	if err := json.Unmarshal(mustMarshal(rawParams), &params); err != nil || params.RequestID == nil {
+		slog.Warn("Ignoring invalid cancellation", "params", rawParams)
+		return
+	}
+
+	s.inflightMu.Lock()
+	req := s.inflight[requestKey(params.RequestID)]
+	s.inflightMu.Unlock()
+
+	if req == nil {
+		slog.Debug("Cancellation for unknown request", "id", params.RequestID)
+		return
+	}
+
+	slog.Info("Cancelling request", "id", params.RequestID, "reason", params.Reason)
+	req.cancel()
+}
+
+func (s *MCPServer) handleSetLevel(id interface{}, params SetLevelParams) error {
+	level, ok := mcpLogLevels[params.Level]
+	if !ok {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid log level: %q", params.Level))
+	}
+
+	s.clientLogLevel.Set(level)
+	s.clientLogEnabled.Store(true)
+
+	slog.Info("Client log level set", "level", params.Level)
+	return s.sendResult(id, struct{}{})
+}
+
+// handleListTools returns one page of the enabled tools in definition
+// order. The cursor names the first tool of the next page, so paging resumes
+// at the right tool even if the set of tools changes between calls.
+func (s *MCPServer) handleListTools(id interface{}, params ListToolsParams) error {
+	slog.Debug("Listing available tools", "cursor", params.Cursor)
+
+	tools := slices.DeleteFunc(toolDefinitions(), func(tool Tool) bool {
+		return !s.toolEnabled(tool.Name)
+	})
+
+	start := 0
+	if params.Cursor != "" {
+		start = -1
+		if name, err := base64.RawURLEncoding.DecodeString(params.Cursor); err == nil {
+			start = slices.IndexFunc(tools, func(t Tool) bool { return t.Name == string(name) })
+		}
+		if start < 0 {
+			return s.sendError(id, -32602, "Invalid cursor")
+		}
+	}
+	end := min(start+s.toolsPageSize, len(tools))
+
+	result := ListToolsResult{
+		Tools: tools[start:end],
+	}
+	if end < len(tools) {
+		result.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(tools[end].Name))
+	}
+
+	slog.Debug("Returning tools", "count", end-start, "total", len(tools))
+	return s.sendResult(id, result)
+}
+
+// toolDefinitions describes every tool the server implements, in tools/list
+// order.
+func toolDefinitions() []Tool {
+	tools := []Tool{
+		{
+			Name:        "read_file",
+			Description: "Read the contents of a file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to read",
+					},
+					"mimeType": map[string]interface{}{
+						"type":        "string",
+						"description": "Override the detected MIME type; non-text types return base64 content (optional)",
+					},
+					"offset": map[string]interface{}{
+						"type":        "integer",
+						"description": "Byte offset to start reading at (optional)",
+					},
+					"limit": map[string]interface{}{
+						"type":        "integer",
+						"description": "Maximum number of bytes to read from offset (optional)",
+					},
+					"start_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "First line to read, 1-based (optional, alternative to offset/limit)",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "Last line to read, inclusive (optional)",
+					},
+					"line_numbers": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Prefix each line with its line number, like cat -n (optional, default false; not with offset/limit)",
+					},
+					"encoding": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{encodingGzip},
+						"description": "Return text gzipped and base64-encoded in an embedded resource blob when that is smaller (optional)",
+					},
+					"if_none_match": map[string]interface{}{
+						"type":        "string",
+						"description": "The etag from an earlier read's meta; if the file still has it, only a not-modified result is returned (optional)",
+					},
+					"decompress": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Return the decompressed content of a .gz file, typed by the name inside it, e.g. data.json.gz as application/json (optional, default false)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "list_directory",
+			Description: "List files and directories in a given path",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the directory to list (optional, defaults to base directory)",
+					},
+					"format": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"text", "json"},
+						"description": "Output format: text for people or json for an array of entries (optional, default text)",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "List subdirectories too, as an indented tree or nested children in json (optional, default false)",
+					},
+					"max_depth": map[string]interface{}{
+						"type":        "integer",
+						"description": "How many levels a recursive listing descends, 1 being the directory itself (optional, default 10)",
+					},
+					"sort_by": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"name", "size", "mtime"},
+						"description": "Sort entries by name, size or modification time (optional, default name)",
+					},
+					"order": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"asc", "desc"},
+						"description": "Sort order (optional, default asc)",
+					},
+					"dirs_first": map[string]interface{}{
+						"type":        "boolean",
+						"description": "List directories before files (optional, default false)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "search_files",
+			Description: "Search for files by name pattern",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"pattern": map[string]interface{}{
+						"type":        "string",
+						"description": "The filename pattern to search for (supports wildcards); patterns with a slash match the relative path and ** matches any number of directories, e.g. src/**/*.go",
+					},
+					"ignore_case": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Match the pattern regardless of case, e.g. README* finds readme.md (optional, default false)",
+					},
+					"max_results": map[string]interface{}{
+						"type":        "integer",
+						"description": "Stop after this many matches (optional, default and at most the server's -max-search-results, 1000 unless configured)",
+					},
+				},
+				"required": []string{"pattern"},
+			},
+		},
+		{
+			Name:        "write_file",
+			Description: "Create or overwrite a file with the given content",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to write",
+					},
+					"content": map[string]interface{}{
+						"type":        "string",
+						"description": "The content to write",
+					},
+				},
+				"required": []string{"path", "content"},
+			},
+		},
+		{
+			Name:        "read_clean",
+			Description: "Read a text file with a leading BOM, trailing whitespace and extra trailing newlines removed (the file itself is not modified)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to read",
+					},
+					"strip_bom": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Remove a leading UTF-8 byte order mark (default true)",
+					},
+					"trim_trailing_whitespace": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Trim trailing spaces and tabs from every line (default true)",
+					},
+					"final_newline": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Ensure the content ends with exactly one newline (default true)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "list_as_markdown",
+			Description: "Render a directory listing as a nested markdown bullet list with file sizes",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the directory to render (optional, defaults to base directory)",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Include the contents of subdirectories (default false)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "list_zip_entries",
+			Description: "List the entries of a zip archive without extracting it",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the zip archive",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "read_zip_entry",
+			Description: "Read a single entry from a zip archive without extracting it (binary content is returned base64-encoded)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the zip archive",
+					},
+					"entry": map[string]interface{}{
+						"type":        "string",
+						"description": "The name of the entry inside the archive",
+					},
+				},
+				"required": []string{"path", "entry"},
+			},
+		},
+		{
+			Name:        "read_markdown_sections",
+			Description: "Split a markdown file into sections by heading, or return a single named section",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the markdown file",
+					},
+					"section": map[string]interface{}{
+						"type":        "string",
+						"description": "Only return the content of the heading with this title, including its subsections (optional, case-insensitive)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "dir_mtime",
+			Description: "Return the most recent modification time of any file in a directory tree",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the directory (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "same_file",
+			Description: "Check whether two paths refer to the same underlying file (hardlinks or symlink aliases)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"pathA": map[string]interface{}{
+						"type":        "string",
+						"description": "The first path to compare",
+					},
+					"pathB": map[string]interface{}{
+						"type":        "string",
+						"description": "The second path to compare",
+					},
+				},
+				"required": []string{"pathA", "pathB"},
+			},
+		},
+		{
+			Name:        "read_char_range",
+			Description: "Read a range of characters (Unicode code points, not bytes) from a UTF-8 text file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to read",
+					},
+					"start": map[string]interface{}{
+						"type":        "integer",
+						"description": "Character offset to start at (inclusive, zero-based)",
+					},
+					"end": map[string]interface{}{
+						"type":        "integer",
+						"description": "Character offset to stop at (exclusive)",
+					},
+				},
+				"required": []string{"path", "start", "end"},
+			},
+		},
+		{
+			Name:        "largest_directories",
+			Description: "List the directories with the most entries",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to scan (optional, defaults to base directory)",
+					},
+					"count": map[string]interface{}{
+						"type":        "integer",
+						"description": "How many directories to return (default 10)",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Count all descendants instead of immediate children (default false)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "validate_paths",
+			Description: "Check whether each of a set of paths stays inside the served directory, without touching the files",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"paths": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "The paths to validate",
+					},
+				},
+				"required": []string{"paths"},
+			},
+		},
+		{
+			Name:        "read_with_offsets",
+			Description: "Read a text file with each line prefixed by its starting byte offset",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to read",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "file_fingerprint",
+			Description: "Return a cheap fingerprint of a file: size, modification time, CRC32 and the first and last 64 bytes as hex",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to fingerprint",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "find_unmatched",
+			Description: "Find files whose name or relative path matches none of the given glob patterns",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"patterns": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "Glob patterns in the search_files syntax: without a slash they match a file name, with one the relative path, and ** matches any number of directories, e.g. src/**/*_test.go",
+					},
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to scan (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{"patterns"},
+			},
+		},
+		{
+			Name:        "tree_json",
+			Description: "Return a directory tree as a flat JSON array of nodes with parent references",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The root directory of the tree (optional, defaults to base directory)",
+					},
+					"maxDepth": map[string]interface{}{
+						"type":        "integer",
+						"description": "How many levels below the root to include (default 10)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "write_if_unchanged",
+			Description: "Replace a file's content only if its current SHA-256 matches the expected hash (compare-and-swap). The check is atomic with respect to other writes through this server, not to other processes writing the file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to write",
+					},
+					"content": map[string]interface{}{
+						"type":        "string",
+						"description": "The new file content",
+					},
+					"expectedHash": map[string]interface{}{
+						"type":        "string",
+						"description": "Hex SHA-256 of the content the caller last saw; empty string means the file must not exist yet",
+					},
+				},
+				"required": []string{"path", "content", "expectedHash"},
+			},
+		},
+		{
+			Name:        "read_first_existing",
+			Description: "Read the first file that exists and is readable from a list of candidate paths",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"paths": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "Candidate paths in order of preference",
+					},
+				},
+				"required": []string{"paths"},
+			},
+		},
+		{
+			Name:        "audit_permissions",
+			Description: "Find files with notable permission bits: world-writable, setuid, setgid or executable",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to audit (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "directory_previews",
+			Description: "List the files in a directory with a short content preview of each",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the directory (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "wait_for_stable",
+			Description: "Wait until a file's size and modification time stop changing, for example after a download or build finishes",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to watch",
+					},
+					"stableFor": map[string]interface{}{
+						"type":        "number",
+						"description": "Seconds the file must stay unchanged (default 2)",
+					},
+					"timeout": map[string]interface{}{
+						"type":        "number",
+						"description": "Maximum seconds to wait (default 30, at most 300)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "project_toc",
+			Description: "Summarize a project: top-level directories with short descriptions, notable config files and file counts by type",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The project root (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "read_audit_log",
+			Description: "Return the most recent entries of the file read audit log (requires the server to run with -audit-log)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"limit": map[string]interface{}{
+						"type":        "integer",
+						"description": "How many of the newest entries to return (default 50, at most 1000)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "scan_secrets",
+			Description: "Scan text files for lines that look like committed credentials (reports file, line and rule, never the secret)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory or file to scan (optional, defaults to base directory)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "read_for_review",
+			Description: "Read a text file formatted for code review, with a right-aligned line-number gutter",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to read",
+					},
+					"start_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "First line to include, 1-based (optional)",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "integer",
+						"description": "Last line to include, inclusive (optional)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "dedup_report",
+			Description: "Report how many bytes could be reclaimed by deduplicating identical files, with the most wasteful duplicate groups",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to analyze (optional, defaults to base directory)",
+					},
+					"count": map[string]interface{}{
+						"type":        "integer",
+						"description": "How many duplicate groups to list (default 20)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "read_numbers",
+			Description: "Parse a file of whitespace- or newline-separated numbers and return the values with count, sum, min, max and mean",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to parse",
+					},
+					"statsOnly": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Return only the statistics, not the values (default false)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "list_readable",
+			Description: "List only the text files under the size limit, skipping binaries and oversized files",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to list (optional, defaults to base directory)",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Include files in subdirectories (default false)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "search_content",
+			Description: "Search the contents of text files for a string or regular expression and return matching lines with their path and line number",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query": map[string]interface{}{
+						"type":        "string",
+						"description": "The text to search for",
+					},
+					"regex": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Treat query as a regular expression (optional, default false)",
+					},
+					"ignore_case": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Match case-insensitively (optional, default false)",
+					},
+					"glob": map[string]interface{}{
+						"type":        "string",
+						"description": "Only search files matching this pattern in the search_files syntax, e.g. *.go or docs/**/*.md (optional)",
+					},
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory or file to search (optional, defaults to base directory)",
+					},
+					"max_file_size": map[string]interface{}{
+						"type":        "integer",
+						"description": "Skip files larger than this many bytes (optional, defaults to the server's file size limit)",
+					},
+				},
+				"required": []string{"query"},
+			},
+		},
+		{
+			Name:        "delete_path",
+			Description: "Delete a file or directory inside the base directory",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The file or directory to delete",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Delete a non-empty directory and everything in it (optional, default false)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "move_file",
+			Description: "Move or rename a file or directory within the base directory",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"source": map[string]interface{}{
+						"type":        "string",
+						"description": "The file or directory to move",
+					},
+					"destination": map[string]interface{}{
+						"type":        "string",
+						"description": "The new path",
+					},
+					"overwrite": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Replace the destination if it already exists (optional, default false)",
+					},
+				},
+				"required": []string{"source", "destination"},
+			},
+		},
+		{
+			Name:        "file_info",
+			Description: "Get metadata for a file, directory or symlink: size, mode, modification time, type and MIME type",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to inspect",
+					},
+					"json": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Return a JSON object instead of a text block (optional, default false)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "create_directory",
+			Description: "Create a directory, including any missing parents, inside the base directory",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to create",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "copy_file",
+			Description: "Copy a file, or with recursive a whole directory tree, within the base directory",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"source": map[string]interface{}{
+						"type":        "string",
+						"description": "The file or directory to copy",
+					},
+					"destination": map[string]interface{}{
+						"type":        "string",
+						"description": "The path of the copy",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Copy a directory and everything in it (optional, default false)",
+					},
+					"overwrite": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Replace existing files at the destination (optional, default false)",
+					},
+				},
+				"required": []string{"source", "destination"},
+			},
+		},
+		{
+			Name:        "file_hash",
+			Description: "Compute a checksum of a file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to hash",
+					},
+					"algorithm": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"md5", "sha1", "sha256"},
+						"description": "Hash algorithm (optional, default sha256)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "preview_file",
+			Description: "Show the first or last lines of a text file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to preview",
+					},
+					"lines": map[string]interface{}{
+						"type":        "integer",
+						"description": "Number of lines to show (optional, default 10)",
+					},
+					"from": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"head", "tail"},
+						"description": "Show lines from the start (head) or the end (tail) of the file (optional, default head)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "append_file",
+			Description: "Append content to the end of a file, creating it if it does not exist",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to append to",
+					},
+					"content": map[string]interface{}{
+						"type":        "string",
+						"description": "The content to append",
+					},
+					"create_parents": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Create missing parent directories (optional, default false)",
+					},
+				},
+				"required": []string{"path", "content"},
+			},
+		},
+		{
+			Name:        "watch_file",
+			Description: "Wait until a file is created, modified or deleted, or until a timeout",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to watch; it does not need to exist yet",
+					},
+					"timeout_seconds": map[string]interface{}{
+						"type":        "number",
+						"description": "How long to wait for a change (optional, default 30, at most 300)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "edit_file",
+			Description: "Find and replace text in a file",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to edit",
+					},
+					"search": map[string]interface{}{
+						"type":        "string",
+						"description": "The text to find, or a regular expression when regex is set",
+					},
+					"replace": map[string]interface{}{
+						"type":        "string",
+						"description": "The replacement text; with regex, $1 or ${name} refer to capture groups",
+					},
+					"all": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Replace every match instead of only the first (optional, default false)",
+					},
+					"regex": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Treat search as a Go regular expression (optional, default false)",
+					},
+				},
+				"required": []string{"path", "search", "replace"},
+			},
+		},
+		{
+			Name:        "directory_size",
+			Description: "Total the size of all files under a directory",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The directory to measure (optional, defaults to base directory)",
+					},
+					"human": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Also report the total in KB, MB or GB (optional, default false)",
+					},
+				},
+				"required": []string{},
+			},
+		},
+		{
+			Name:        "read_files",
+			Description: "Read several files in one call, returning one content block per file; files that cannot be read get an inline error instead of failing the batch",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"paths": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"maxItems":    maxReadFiles,
+						"description": "Paths of the files to read",
+					},
+				},
+				"required": []string{"paths"},
+			},
+		},
+		{
+			Name:        "get_tree",
+			Description: "Render a directory and everything below it as an ASCII tree, like the tree command, for a one-shot overview. Honours the server's include/exclude filters and .gitignore when enabled",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Directory to render (optional, defaults to the served directory)",
+					},
+					"max_depth": map[string]interface{}{
+						"type":        "integer",
+						"description": fmt.Sprintf("How many levels to descend (optional, default %d)", defaultMaxDepth),
+					},
+					"dirs_only": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Leave files out and show only directories (optional, default false)",
+					},
+				},
+			},
+		},
+		{
+			Name:        "file_stats",
+			Description: "Count the lines, words, characters and bytes of a file, like wc, and report its line endings and encoding",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "The path to the file to count",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+	}
+
+	// Any tool but the detached ones can be given a deadline shorter than
+	// -tool-timeout; see handleCallTool.
+	for _, tool := range tools {
+		if detachedTools[tool.Name] {
+			continue
+		}
+		properties := tool.InputSchema["properties"].(map[string]interface{})
+		properties["timeout_seconds"] = map[string]interface{}{
+			"type":        "number",
+			"description": "Give up on the call after this many seconds (optional, at most the server's -tool-timeout)",
+		}
+	}
+	return tools
+}
+
+func (s *MCPServer) handleCallTool(ctx context.Context, id interface{}, params CallToolParams) error {
+	slog.Debug("Calling tool", "tool", params.Name, "arguments", params.Arguments)
+
+	// A disabled tool is indistinguishable from one that does not exist.
+	if !s.toolEnabled(params.Name) {
+		return s.sendError(id, -32601, fmt.Sprintf("Tool not found: %s", params.Name))
+	}
+
+	// Detached tools take their own timeout_seconds and wait that long.
+	if detachedTools[params.Name] {
+		return s.callTool(ctx, id, params)
+	}
+
+	timeout := s.toolTimeout
+	if _, ok := params.Arguments["timeout_seconds"]; ok {
+		seconds, err := getOptionalNumberArg(params.Arguments, "timeout_seconds", 0)
+		if err != nil {
+			return s.sendError(id, -32602, err.Error())
+		}
+		if seconds <= 0 || (s.toolTimeout > 0 && seconds > s.toolTimeout.Seconds()) {
+			if s.toolTimeout > 0 {
+				return s.sendError(id, -32602, fmt.Sprintf("Invalid timeout_seconds: must be positive and at most %g", s.toolTimeout.Seconds()))
+			}
+			return s.sendError(id, -32602, "Invalid timeout_seconds: must be positive")
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return s.callTool(ctx, id, params)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := s.callTool(callCtx, id, params)
+	// Handlers give up on an expired context without answering; a
+	// cancelled request gets no answer, but a timed-out one does.
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		slog.Info("Tool call timed out", "tool", params.Name, "timeout", timeout)
+		return s.sendToolResult(id, fmt.Sprintf("Tool call timed out after %s: %s", timeout, params.Name), true)
+	}
+	return err
+}
+
+// callTool dispatches a tools/call to its handler.
+func (s *MCPServer) callTool(ctx context.Context, id interface{}, params CallToolParams) error {
+	switch params.Name {
+	case "read_file":
+		return s.handleReadFileTool(id, params.Arguments)
+	case "list_directory":
+		return s.handleListDirectoryTool(ctx, id, params.Arguments)
+	case "search_files":
+		return s.handleSearchFilesTool(ctx, id, params.Arguments)
+	case "write_file":
+		return s.handleWriteFileTool(id, params.Arguments)
+	case "read_clean":
+		return s.handleReadCleanTool(id, params.Arguments)
+	case "list_as_markdown":
+		return s.handleListAsMarkdownTool(id, params.Arguments)
+	case "list_zip_entries":
+		return s.handleListZipEntriesTool(id, params.Arguments)
+	case "read_zip_entry":
+		return s.handleReadZipEntryTool(id, params.Arguments)
+	case "read_markdown_sections":
+		return s.handleReadMarkdownSectionsTool(id, params.Arguments)
+	case "dir_mtime":
+		return s.handleDirMtimeTool(ctx, id, params.Arguments)
+	case "same_file":
+		return s.handleSameFileTool(id, params.Arguments)
+	case "read_char_range":
+		return s.handleReadCharRangeTool(id, params.Arguments)
+	case "largest_directories":
+		return s.handleLargestDirectoriesTool(ctx, id, params.Arguments)
+	case "validate_paths":
+		return s.handleValidatePathsTool(id, params.Arguments)
+	case "read_with_offsets":
+		return s.handleReadWithOffsetsTool(id, params.Arguments)
+	case "file_fingerprint":
+		return s.handleFileFingerprintTool(id, params.Arguments)
+	case "find_unmatched":
+		return s.handleFindUnmatchedTool(ctx, id, params.Arguments)
+	case "tree_json":
+		return s.handleTreeJSONTool(ctx, id, params.Arguments)
+	case "write_if_unchanged":
+		return s.handleWriteIfUnchangedTool(id, params.Arguments)
+	case "read_first_existing":
+		return s.handleReadFirstExistingTool(id, params.Arguments)
+	case "audit_permissions":
+		return s.handleAuditPermissionsTool(ctx, id, params.Arguments)
+	case "directory_previews":
+		return s.handleDirectoryPreviewsTool(id, params.Arguments)
+	case "wait_for_stable":
+		return s.handleWaitForStableTool(ctx, id, params.Arguments)
+	case "project_toc":
+		return s.handleProjectTOCTool(ctx, id, params.Arguments)
+	case "read_audit_log":
+		return s.handleReadAuditLogTool(id, params.Arguments)
+	case "scan_secrets":
+		return s.handleScanSecretsTool(ctx, id, params.Arguments)
+	case "read_for_review":
+		return s.handleReadForReviewTool(id, params.Arguments)
+	case "dedup_report":
+		return s.handleDedupReportTool(ctx, id, params.Arguments)
+	case "read_numbers":
+		return s.handleReadNumbersTool(id, params.Arguments)
+	case "list_readable":
+		return s.handleListReadableTool(ctx, id, params.Arguments)
+	case "search_content":
+		return s.handleSearchContentTool(ctx, id, params.Arguments)
+	case "delete_path":
+		return s.handleDeletePathTool(id, params.Arguments)
+	case "move_file":
+		return s.handleMoveFileTool(id, params.Arguments)
+	case "file_info":
+		return s.handleFileInfoTool(id, params.Arguments)
+	case "create_directory":
+		return s.handleCreateDirectoryTool(id, params.Arguments)
+	case "copy_file":
+		return s.handleCopyFileTool(ctx, id, params.Arguments)
+	case "file_hash":
+		return s.handleFileHashTool(id, params.Arguments)
+	case "preview_file":
+		return s.handlePreviewFileTool(id, params.Arguments)
+	case "append_file":
+		return s.handleAppendFileTool(id, params.Arguments)
+	case "watch_file":
+		return s.handleWatchFileTool(ctx, id, params.Arguments)
+	case "edit_file":
+		return s.handleEditFileTool(id, params.Arguments)
+	case "directory_size":
+		return s.handleDirectorySizeTool(ctx, id, params.Arguments)
+	case "read_files":
+		return s.handleReadFilesTool(id, params.Arguments)
+	case "get_tree":
+		return s.handleGetTreeTool(ctx, id, params.Arguments)
+	case "file_stats":
+		return s.handleFileStatsTool(ctx, id, params.Arguments)
+	default:
+		return s.sendError(id, -32601, fmt.Sprintf("Tool not found: %s", params.Name))
+	}
+}
+
+func (s *MCPServer) handleReadFileTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	mimeType, err := getOptionalStringArg(args, "mimeType", "")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if mimeType != "" && !isValidMimeType(mimeType) {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid mimeType: %s", mimeType))
+	}
+
+	offset, err := getOptionalIntArg(args, "offset", -1)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	limit, err := getOptionalIntArg(args, "limit", -1)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	startLine, err := getOptionalIntArg(args, "start_line", 0)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	endLine, err := getOptionalIntArg(args, "end_line", 0)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	lineNumbers, err := getOptionalBoolArg(args, "line_numbers", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	encoding, err := getOptionalStringArg(args, "encoding", "")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	ifNoneMatch, err := getOptionalStringArg(args, "if_none_match", "")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if encoding != "" && encoding != encodingGzip {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid encoding argument: %s (supported: %s)", encoding, encodingGzip))
+	}
+	decompress, err := getOptionalBoolArg(args, "decompress", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	_, hasOffset := args["offset"]
+	_, hasLimit := args["limit"]
+	_, hasStartLine := args["start_line"]
+	_, hasEndLine := args["end_line"]
+	byteRange := hasOffset || hasLimit
+	lineRange := hasStartLine || hasEndLine
+
+	if byteRange && lineRange {
+		return s.sendError(id, -32602, "Use either offset/limit or start_line/end_line, not both")
+	}
+	if byteRange && lineNumbers {
+		return s.sendError(id, -32602, "line_numbers cannot be combined with offset/limit")
+	}
+	if hasOffset && offset < 0 {
+		return s.sendError(id, -32602, "Invalid offset argument: must be non-negative")
+	}
+	if hasLimit && limit < 0 {
+		return s.sendError(id, -32602, "Invalid limit argument: must be non-negative")
+	}
+	if hasStartLine && startLine < 1 {
+		return s.sendError(id, -32602, "Invalid start_line argument: must be at least 1")
+	}
+	if hasEndLine && (endLine < 1 || (hasStartLine && endLine < startLine)) {
+		return s.sendError(id, -32602, "Invalid end_line argument: must be at least 1 and not before start_line")
+	}
+	if decompress && !strings.HasSuffix(strings.ToLower(path), ".gz") {
+		return s.sendError(id, -32602, "decompress only applies to .gz files")
+	}
+	if decompress && (byteRange || lineRange) {
+		return s.sendError(id, -32602, "decompress cannot be combined with offset/limit or start_line/end_line")
+	}
+
+	// Security check: ensure the file is within a served directory
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// The etag is taken before reading, so a file that changes meanwhile is
+	// sent again next time rather than wrongly reported unchanged.
+	var etag string
+	if info, err := s.files.Stat(absPath); err == nil {
+		if info.IsDir() {
+			return s.sendToolResult(id, fmt.Sprintf("Path is a directory: %s; use list_directory to see what it contains", path), true)
+		}
+		etag = fileETag(info, readVariant(args))
+	}
+	if etag != "" && ifNoneMatch == etag {
+		return s.sendResult(id, CallToolResult{
+			Content: []ToolContent{{Type: "text", Text: fmt.Sprintf("Not modified: %s", path)}},
+			Meta:    map[string]interface{}{"etag": etag, "notModified": true},
+		})
+	}
+
+	// Read file content, or just the requested range of it
+	var content []byte
+	var notes []string
+
+	// A range is capped at the size limit too, rather than refused, since
+	// reading part of a large file is exactly what ranges are for.
+	if byteRange && (limit < 0 || int64(limit) > s.maxFileSize) {
+		limit = int(s.maxFileSize)
+	}
+
+	// A decompressed file is typed by the name inside the .gz.
+	ext := filepath.Ext(absPath)
+	if decompress {
+		ext = filepath.Ext(absPath[:len(absPath)-len(".gz")])
+		notes = append(notes, "decompressed")
+	}
+
+	firstLine := 1
+	switch {
+	case decompress:
+		content, err = readGzipFile(s.files, absPath, s.maxFileSize)
+	case byteRange:
+		var start, end, size int64
+		content, start, end, size, err = readByteRange(s.files, absPath, int64(offset), int64(limit))
+		if err == nil {
+			notes = append(notes, fmt.Sprintf("bytes %d-%d of %d", start, end, size))
+		}
+	case lineRange:
+		var last int
+		var truncated bool
+		content, firstLine, last, truncated, err = readLineRange(s.files, absPath, startLine, endLine, s.maxFileSize)
+		if err == nil {
+			notes = append(notes, fmt.Sprintf("lines %d-%d", firstLine, last))
+		}
+		if truncated {
+			notes = append(notes, fmt.Sprintf("truncated at the %d-byte limit; continue from start_line %d", s.maxFileSize, last))
+		}
+	default:
+		content, err = s.readFileLimited(absPath)
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		var tooLarge *FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			return s.sendToolResult(id, fmt.Sprintf("File too large: %s is %d bytes, over the limit of %d bytes; read part of it with offset/limit or start_line/end_line", path, tooLarge.Size, tooLarge.Limit), true)
+		}
+		if errors.Is(err, errDecompressedTooLarge) {
+			return s.sendToolResult(id, fmt.Sprintf("File too large: %s decompresses to more than the limit of %d bytes", path, s.maxFileSize), true)
+		}
+		var badGzip *invalidGzipError
+		if errors.As(err, &badGzip) {
+			return s.sendToolResult(id, fmt.Sprintf("Not a valid gzip file: %s (%v)", path, err), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	s.recordAudit("read_file", s.relativePath(absPath), "", len(content))
+
+	// A range may cut a multi-byte character, so classify ranged reads by
+	// the start of the file instead of the slice itself.
+	var binary bool
+	if byteRange || lineRange {
+		binary = isBinaryFile(s.files, absPath)
+	} else {
+		binary = isBinaryContent(content)
+	}
+	if mimeType != "" {
+		notes = append(notes, mimeType)
+		binary = !isTextMimeType(mimeType)
+	} else if decompress {
+		notes = append(notes, s.detectMimeType(ext, content))
+	}
+
+	text := string(content)
+	if binary {
+		notes = append(notes, "base64")
+		text = base64.StdEncoding.EncodeToString(content)
+	} else if lineNumbers {
+		text = numberLines(content, firstLine)
+	}
+
+	var blob string
+	compressed := false
+	if !binary {
+		blob, compressed = gzipBase64IfSmaller([]byte(text), encoding)
+	}
+	if compressed {
+		notes = append(notes, "gzip")
+	}
+
+	header := fmt.Sprintf("Contents of %s", path)
+	if len(notes) > 0 {
+		header += fmt.Sprintf(" (%s)", strings.Join(notes, ", "))
+	}
+
+	if compressed {
+		if mimeType == "" {
+			mimeType = s.detectMimeType(ext, content)
+		}
+		return s.sendResult(id, CallToolResult{
+			Content: []ToolContent{
+				{Type: "text", Text: header + ": content is in the attached gzip blob"},
+				{Type: "resource", Resource: &ResourceContent{
+					URI:      s.resourceURI(absPath),
+					MimeType: mimeType,
+					Blob:     blob,
+					Meta:     gzipMeta(len(text)),
+				}},
+			},
+			Meta: map[string]interface{}{"etag": etag},
+		})
+	}
+
+	return s.sendResult(id, CallToolResult{
+		Content: []ToolContent{{Type: "text", Text: fmt.Sprintf("%s:\n%s", header, text)}},
+		Meta:    map[string]interface{}{"etag": etag},
+	})
+}
+
+func (s *MCPServer) handleListDirectoryTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	targetDir, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	format, err := getOptionalStringArg(args, "format", "text")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if format != "text" && format != "json" {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid format: %s (use text or json)", format))
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	maxDepth, err := getOptionalIntArg(args, "max_depth", defaultMaxDepth)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if maxDepth < 1 {
+		return s.sendError(id, -32602, "Invalid max_depth argument: must be at least 1")
+	}
+	if !recursive {
+		maxDepth = 1
+	}
+
+	sortBy, err := getOptionalStringArg(args, "sort_by", "name")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if sortBy != "name" && sortBy != "size" && sortBy != "mtime" {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid sort_by: %s (use name, size or mtime)", sortBy))
+	}
+
+	order, err := getOptionalStringArg(args, "order", "asc")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if order != "asc" && order != "desc" {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid order: %s (use asc or desc)", order))
+	}
+
+	dirsFirst, err := getOptionalBoolArg(args, "dirs_first", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// With several roots the top level is the list of roots themselves.
+	if len(s.roots) > 1 && filepath.Clean(targetDir) == "." {
+		if format == "json" {
+			entries := make([]DirEntry, 0, len(s.roots))
+			for _, root := range s.roots {
+				entry := DirEntry{Name: root.Name, IsDir: true}
+				if info, err := s.files.Stat(root.Dir); err == nil {
+					entry.Modified = info.ModTime().Format(time.RFC3339)
+				}
+				entries = append(entries, entry)
+			}
+			return s.sendDirEntries(id, entries)
+		}
+
+		var result strings.Builder
+		result.WriteString("Served roots:\n")
+		for _, root := range s.roots {
+			result.WriteString(fmt.Sprintf("📁 %s/ (%s)\n", root.Name, root.Dir))
+		}
+		return s.sendToolResult(id, result.String(), false)
+	}
+
+	// Security check
+	absPath, err := s.resolvePath(targetDir)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if info, err := s.files.Stat(absPath); err == nil && !info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Not a directory: %s; use read_file to read it", targetDir), true)
+	}
+
+	// List directory contents
+	count := 0
+	listed, err := s.listDirEntries(ctx, absPath, 1, maxDepth, &count)
+	truncated := errors.Is(err, errListingTruncated)
+	if err != nil && !truncated {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", targetDir), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+	}
+	sortDirEntries(listed, sortBy, order == "desc", dirsFirst)
+
+	if format == "json" {
+		if truncated {
+			return s.sendToolResult(id, fmt.Sprintf("Listing has more than %d entries; lower max_depth or list a subdirectory", maxTreeNodes), true)
+		}
+		return s.sendDirEntries(id, listed)
+	}
+
+	var result strings.Builder
+	relPath := s.relativePath(absPath)
+	if relPath == "." {
+		result.WriteString("Contents of base directory:\n")
+	} else {
+		result.WriteString(fmt.Sprintf("Contents of %s:\n", relPath))
+	}
+
+	writeDirEntries(&result, listed, "")
+	if truncated {
+		result.WriteString(fmt.Sprintf("(listing truncated after %d entries)\n", maxTreeNodes))
+	}
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+// errListingTruncated stops a list_directory walk at maxTreeNodes entries.
+var errListingTruncated = errors.New("listing truncated")
+
+// listDirEntries lists absPath for list_directory, descending into
+// subdirectories while depth < maxDepth. count is shared across the whole
+// tree, and once it reaches maxTreeNodes the entries so far are returned with
+// errListingTruncated. Subdirectories that cannot be read are listed without
+// children.
+func (s *MCPServer) listDirEntries(ctx context.Context, absPath string, depth, maxDepth int, count *int) ([]DirEntry, error) {
+	entries, err := s.files.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make([]DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		entryPath := filepath.Join(absPath, entry.Name())
+		if s.isReservedPath(entryPath) || s.isFilteredOut(entryPath, entry.IsDir()) {
+			continue
+		}
+
+		if *count >= maxTreeNodes {
+			return listed, errListingTruncated
+		}
+		*count++
+
+		dirEntry := newDirEntry(entry)
+		if entry.IsDir() && depth < maxDepth {
+			children, err := s.listDirEntries(ctx, entryPath, depth+1, maxDepth, count)
+			dirEntry.Children = children
+			if errors.Is(err, errListingTruncated) || ctx.Err() != nil {
+				return append(listed, dirEntry), err
+			}
+		}
+		listed = append(listed, dirEntry)
+	}
+	return listed, nil
+}
+
+// sortDirEntries orders a listing, and the children of every directory in
+// it, by name, size or mtime. Ties fall back to the name, and dirsFirst puts
+// directories ahead of files whatever the order.
+func sortDirEntries(entries []DirEntry, by string, desc, dirsFirst bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if dirsFirst && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case by == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case by == "mtime" && !a.modTime.Equal(b.modTime):
+			return a.modTime.Before(b.modTime)
+		}
+		return a.Name < b.Name
+	})
+
+	for _, entry := range entries {
+		sortDirEntries(entry.Children, by, desc, dirsFirst)
+	}
+}
+
+// writeDirEntries renders entries as list_directory text, indenting the
+// children of each directory one level further.
+func writeDirEntries(b *strings.Builder, entries []DirEntry, indent string) {
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir:
+			b.WriteString(fmt.Sprintf("%s📁 %s/\n", indent, entry.Name))
+			writeDirEntries(b, entry.Children, indent+"  ")
+		case entry.Modified != "":
+			b.WriteString(fmt.Sprintf("%s📄 %s (%d bytes)\n", indent, entry.Name, entry.Size))
+		default:
+			b.WriteString(fmt.Sprintf("%s📄 %s\n", indent, entry.Name))
+		}
+	}
+}
+
+// DirEntry is one entry of a list_directory result in json format.
+type DirEntry struct {
+	Name     string `json:"name"`
+	IsDir    bool   `json:"is_dir"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified,omitempty"`
+
+	// URI is set in directory listings read with resources/read.
+	URI string `json:"uri,omitempty"`
+
+	// Children holds a directory's entries in a recursive listing.
+	Children []DirEntry `json:"children,omitempty"`
+
+	modTime time.Time
+}
+
+// newDirEntry describes a directory entry. Size and Modified stay empty when
+// the entry cannot be stat'ed, e.g. because it was removed meanwhile.
+func newDirEntry(entry fs.DirEntry) DirEntry {
+	result := DirEntry{Name: entry.Name(), IsDir: entry.IsDir()}
+	if info, err := entry.Info(); err == nil {
+		if !result.IsDir {
+			result.Size = info.Size()
+		}
+		result.Modified = info.ModTime().Format(time.RFC3339)
+		result.modTime = info.ModTime()
+	}
+	return result
+}
+
+// sendDirEntries sends a list_directory result in json format.
+func (s *MCPServer) sendDirEntries(id interface{}, entries []DirEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleSearchFilesTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	pattern, err := getStringArg(args, "pattern")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	ignoreCase, err := getOptionalBoolArg(args, "ignore_case", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	// Ignoring case lowercases the pattern and each path before matching;
+	// results keep the path's own case.
+	fold := func(name string) string { return name }
+	if ignoreCase {
+		fold = strings.ToLower
+	}
+
+	maxResults, err := getOptionalIntArg(args, "max_results", s.maxSearchResults)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if maxResults < 1 || maxResults > s.maxSearchResults {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid max_results argument: must be between 1 and %d", s.maxSearchResults))
+	}
+
+	matcher, err := compilePathGlob(fold(pattern))
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid pattern argument: %v", err))
+	}
+
+	var matches []string
+	truncated := false
+	progress := s.progressReporter(ctx)
+	scanned := 0
+
+	for _, root := range s.roots {
+		ignore := s.newGitignoreMatcher(root.Dir)
+
+		err := s.walkDir(root.Dir, func(path string, d fs.DirEntry, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+
+			if skip, err := ignore.skip(path, d, root.Dir); skip {
+				return err
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			scanned++
+			progress.update(scanned)
+
+			if s.isReservedPath(path) || s.isFilteredOut(path, false) {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(root.Dir, path)
+			if err != nil {
+				return err
+			}
+
+			// With several roots the root-prefixed name matches too.
+			name := s.relativePath(path)
+			if matcher.MatchString(fold(filepath.ToSlash(relPath))) || matcher.MatchString(fold(filepath.ToSlash(name))) {
+				// One match past the cap proves there are more.
+				if len(matches) == maxResults {
+					return errSearchTruncated
+				}
+				matches = append(matches, name)
+			}
+
+			return nil
+		})
+
+		if errors.Is(err, errSearchTruncated) {
+			truncated = true
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return s.sendToolResult(id, fmt.Sprintf("Search failed: %v", err), true)
+		}
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Files matching pattern '%s':\n", pattern))
+
+	if len(matches) == 0 {
+		result.WriteString("No files found matching the pattern.")
+	} else {
+		for _, match := range matches {
+			result.WriteString(fmt.Sprintf("📄 %s\n", match))
+		}
+	}
+	if truncated {
+		result.WriteString(fmt.Sprintf("(results truncated: showing the first %d matches, there are more; narrow the pattern or raise max_results)\n", len(matches)))
+	}
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+func (s *MCPServer) handleWriteFileTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := getStringArg(args, "content")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if info, err := s.files.Stat(filepath.Dir(absPath)); err != nil || !info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(path)), true)
+	}
+
+	if s.dryRun {
+		return s.sendDryRun(id, "write %s to %s%s", formatByteSize(int64(len(content))), path, describeReplaced(s.files, absPath))
+	}
+
+	unlock := s.lockFile(absPath)
+	defer unlock()
+	if err := writeFileAtomic(s.files, absPath, []byte(content), 0644); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to write file: %v", err), true)
+	}
+
+	slog.Info("Wrote file", "path", absPath, "bytes", len(content))
+	return s.sendToolResult(id, fmt.Sprintf("Wrote %d bytes to %s", len(content), path), false)
+}
+
+func (s *MCPServer) handleReadCleanTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	stripBOM, err := getOptionalBoolArg(args, "strip_bom", true)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	trimTrailing, err := getOptionalBoolArg(args, "trim_trailing_whitespace", true)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	finalNewline, err := getOptionalBoolArg(args, "final_newline", true)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	if isBinaryContent(content) {
+		return s.sendToolResult(id, fmt.Sprintf("File is not a text file: %s", path), true)
+	}
+	s.recordAudit("read_clean", s.relativePath(absPath), "", len(content))
+
+	text := string(content)
+	var applied []string
+
+	if stripBOM && strings.HasPrefix(text, utf8BOM) {
+		text = strings.TrimPrefix(text, utf8BOM)
+		applied = append(applied, "stripped BOM")
+	}
+
+	if trimTrailing {
+		lines := strings.Split(text, "\n")
+		trimmed := 0
+		for i, line := range lines {
+			cleaned := strings.TrimRight(line, " \t\r")
+			// Keep CRLF line endings intact, only the whitespace before them goes.
+			if strings.HasSuffix(line, "\r") {
+				cleaned += "\r"
+			}
+			if cleaned != line {
+				lines[i] = cleaned
+				trimmed++
+			}
+		}
+		if trimmed > 0 {
+			text = strings.Join(lines, "\n")
+			applied = append(applied, fmt.Sprintf("trimmed trailing whitespace on %d lines", trimmed))
+		}
+	}
+
+	if finalNewline && text != "" {
+		ending := "\n"
+		if strings.Contains(text, "\r\n") {
+			ending = "\r\n"
+		}
+		normalized := strings.TrimRight(text, "\r\n") + ending
+		if normalized != text {
+			text = normalized
+			applied = append(applied, "normalized final newline")
+		}
+	}
+
+	note := "no transformations applied"
+	if len(applied) > 0 {
+		note = strings.Join(applied, ", ")
+	}
+
+	result := fmt.Sprintf("Contents of %s (%s):\n%s", path, note, text)
+	return s.sendToolResult(id, result, false)
+}
+
+func (s *MCPServer) handleListAsMarkdownTool(id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	var result strings.Builder
+	count := 0
+	truncated, err := s.writeMarkdownTree(&result, absPath, 0, recursive, &count)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+	}
+
+	if count == 0 {
+		result.WriteString("_(empty directory)_\n")
+	}
+	if truncated {
+		result.WriteString(fmt.Sprintf("\n_Listing truncated after %d entries._\n", maxMarkdownEntries))
+	}
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+type ZipEntryInfo struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+	Modified       string `json:"modified"`
+	IsDir          bool   `json:"is_dir"`
+	Unsafe         bool   `json:"unsafe,omitempty"`
+}
+
+func (s *MCPServer) handleListZipEntriesTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	reader, archive, err := openZip(s.files, absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to open zip archive: %v", err), true)
+	}
+	defer archive.Close()
+
+	entries := make([]ZipEntryInfo, 0, len(reader.File))
+	for _, f := range reader.File {
+		entries = append(entries, ZipEntryInfo{
+			Name:           f.Name,
+			Size:           f.UncompressedSize64,
+			CompressedSize: f.CompressedSize64,
+			Modified:       f.Modified.Format(time.RFC3339),
+			IsDir:          f.FileInfo().IsDir(),
+			Unsafe:         !isSafeZipEntryName(f.Name),
+		})
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode entries: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadZipEntryTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	entryName, err := getStringArg(args, "entry")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if !isSafeZipEntryName(entryName) {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid entry name: %s", entryName))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	reader, archive, err := openZip(s.files, absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to open zip archive: %v", err), true)
+	}
+	defer archive.Close()
+
+	var entry *zip.File
+	for _, f := range reader.File {
+		if f.Name == entryName && isSafeZipEntryName(f.Name) {
+			entry = f
+			break
+		}
+	}
+	if entry == nil {
+		return s.sendToolResult(id, fmt.Sprintf("Entry not found in %s: %s", path, entryName), true)
+	}
+	if entry.FileInfo().IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Entry is a directory: %s", entryName), true)
+	}
+	if entry.UncompressedSize64 > uint64(s.maxFileSize) {
+		return s.sendToolResult(id, fmt.Sprintf("Entry too large: %d bytes exceeds limit of %d bytes", entry.UncompressedSize64, s.maxFileSize), true)
+	}
+
+	rc, err := entry.Open()
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to open entry: %v", err), true)
+	}
+	defer rc.Close()
+
+	// The header size can lie, so enforce the limit on what is actually inflated.
+	content, err := io.ReadAll(io.LimitReader(rc, s.maxFileSize+1))
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read entry: %v", err), true)
+	}
+	if int64(len(content)) > s.maxFileSize {
+		return s.sendToolResult(id, fmt.Sprintf("Entry too large: exceeds limit of %d bytes", s.maxFileSize), true)
+	}
+
+	// The entry is logged jar-style, as archive!/entry.
+	s.recordAudit("read_zip_entry", s.relativePath(absPath)+"!/"+entryName, "", len(content))
+
+	// Text or base64 by MIME type; an entry with an unknown extension has
+	// already been sniffed from its content.
+	mimeType := s.detectMimeType(filepath.Ext(entryName), content)
+	if !isTextMimeType(mimeType) {
+		result := fmt.Sprintf("Contents of %s in %s (%s, base64):\n%s", entryName, path, mimeType, base64.StdEncoding.EncodeToString(content))
+		return s.sendToolResult(id, result, false)
+	}
+
+	result := fmt.Sprintf("Contents of %s in %s (%s):\n%s", entryName, path, mimeType, string(content))
+	return s.sendToolResult(id, result, false)
+}
+
+type MarkdownSection struct {
+	Heading string `json:"heading"`
+	Level   int    `json:"level"`
+	Content string `json:"content"`
+}
+
+func (s *MCPServer) handleReadMarkdownSectionsTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	section, err := getOptionalStringArg(args, "section", "")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	if isBinaryContent(content) {
+		return s.sendToolResult(id, fmt.Sprintf("File is not a text file: %s", path), true)
+	}
+	s.recordAudit("read_markdown_sections", s.relativePath(absPath), "", len(content))
+
+	lines := strings.Split(string(content), "\n")
+	sections := parseMarkdownSections(lines)
+
+	hasHeadings := false
+	for _, sec := range sections {
+		if sec.Level > 0 {
+			hasHeadings = true
+			break
+		}
+	}
+	if !hasHeadings {
+		result := fmt.Sprintf("No headings found in %s, returning whole file:\n%s", path, string(content))
+		return s.sendToolResult(id, result, false)
+	}
+
+	if section != "" {
+		text, ok := markdownSectionContent(lines, section)
+		if !ok {
+			return s.sendToolResult(id, fmt.Sprintf("Section not found in %s: %s", path, section), true)
+		}
+		return s.sendToolResult(id, text, false)
+	}
+
+	data, err := json.MarshalIndent(sections, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode sections: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleDirMtimeTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	var latest time.Time
+	var latestPath string
+	fileCount := 0
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		fileCount++
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+			latestPath = p
+		}
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+	}
+
+	if fileCount == 0 {
+		return s.sendToolResult(id, fmt.Sprintf("No files found under %s", path), false)
+	}
+
+	result := fmt.Sprintf("Latest modification under %s: %s (%s, %d files scanned)",
+		path, latest.UTC().Format(time.RFC3339Nano), s.relativePath(latestPath), fileCount)
+	return s.sendToolResult(id, result, false)
+}
+
+type SameFileResult struct {
+	Same    bool   `json:"same"`
+	PathA   string `json:"pathA"`
+	TargetA string `json:"targetA"`
+	PathB   string `json:"pathB"`
+	TargetB string `json:"targetB"`
+}
+
+func (s *MCPServer) handleSameFileTool(id interface{}, args map[string]interface{}) error {
+	pathA, err := getStringArg(args, "pathA")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	pathB, err := getStringArg(args, "pathB")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absA, err := s.resolvePath(pathA)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absB, err := s.resolvePath(pathB)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	result := SameFileResult{PathA: pathA, PathB: pathB}
+	var infos [2]os.FileInfo
+
+	for i, p := range []struct {
+		name   string
+		abs    string
+		target *string
+	}{
+		{pathA, absA, &result.TargetA},
+		{pathB, absB, &result.TargetB},
+	} {
+		resolved, err := s.files.EvalSymlinks(p.abs)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return s.sendToolResult(id, fmt.Sprintf("File not found: %s", p.name), true)
+			}
+			return s.sendToolResult(id, fmt.Sprintf("Failed to resolve %s: %v", p.name, err), true)
+		}
+
+		relTarget, ok := s.realRelativePath(resolved)
+		if !ok {
+			return s.sendError(id, -32602, fmt.Sprintf("Access denied: %s resolves outside allowed directory", p.name))
+		}
+		*p.target = relTarget
+
+		infos[i], err = s.files.Stat(resolved)
+		if err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to stat %s: %v", p.name, err), true)
+		}
+	}
+
+	result.Same = os.SameFile(infos[0], infos[1])
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadCharRangeTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	start, err := getIntArg(args, "start")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	end, err := getIntArg(args, "end")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if start < 0 || end < start {
+		return s.sendError(id, -32602, "Invalid range: start must be non-negative and end must not be before start")
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	if !utf8.Valid(content) {
+		return s.sendToolResult(id, fmt.Sprintf("File is not valid UTF-8: %s", path), true)
+	}
+
+	runes := []rune(string(content))
+	if end > len(runes) {
+		return s.sendToolResult(id, fmt.Sprintf("Range %d-%d out of bounds: %s has %d characters", start, end, path, len(runes)), true)
+	}
+
+	text := string(runes[start:end])
+	s.recordAudit("read_char_range", s.relativePath(absPath), "", len(text))
+
+	result := fmt.Sprintf("Characters %d-%d of %s (%d total):\n%s", start, end, path, len(runes), text)
+	return s.sendToolResult(id, result, false)
+}
+
+type DirectoryCount struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+func (s *MCPServer) handleLargestDirectoriesTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	count, err := getOptionalIntArg(args, "count", 10)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if count <= 0 {
+		return s.sendError(id, -32602, "Invalid count argument: must be positive")
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	counts := make(map[string]int)
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			// Only the scanned directory itself must be readable; anything
+			// below it that is not is left out of the counts.
+			if p == absPath {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if _, ok := counts[p]; !ok {
+				counts[p] = 0
+			}
+		}
+
+		if p == absPath {
+			return nil
+		}
+
+		// Credit the entry to its parent, and with recursive to every ancestor
+		// up to the scanned directory.
+		for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+			counts[dir]++
+			if !recursive || dir == absPath {
+				break
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+	}
+
+	dirs := make([]DirectoryCount, 0, len(counts))
+	for dir, n := range counts {
+		dirs = append(dirs, DirectoryCount{Path: s.relativePath(dir), Count: n})
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Count != dirs[j].Count {
+			return dirs[i].Count > dirs[j].Count
+		}
+		return dirs[i].Path < dirs[j].Path
+	})
+
+	if len(dirs) > count {
+		dirs = dirs[:count]
+	}
+
+	data, err := json.MarshalIndent(dirs, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type PathVerdict struct {
+	Path      string `json:"path"`
+	Contained bool   `json:"contained"`
+	Resolved  string `json:"resolved,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (s *MCPServer) handleValidatePathsTool(id interface{}, args map[string]interface{}) error {
+	paths, err := getStringArrayArg(args, "paths")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	verdicts := make([]PathVerdict, 0, len(paths))
+	for _, path := range paths {
+		verdict := PathVerdict{Path: path}
+
+		absPath, err := s.resolvePath(path)
+		if err != nil {
+			verdict.Reason = err.Error()
+			verdicts = append(verdicts, verdict)
+			continue
+		}
+
+		resolved, err := evalSymlinksPartial(s.files, absPath)
+		if err != nil {
+			verdict.Reason = fmt.Sprintf("Failed to resolve symlinks: %v", err)
+			verdicts = append(verdicts, verdict)
+			continue
+		}
+
+		relResolved, ok := s.realRelativePath(resolved)
+		if !ok {
+			verdict.Reason = "Access denied: path resolves outside allowed directory"
+			verdicts = append(verdicts, verdict)
+			continue
+		}
+
+		verdict.Contained = true
+		verdict.Resolved = relResolved
+		verdicts = append(verdicts, verdict)
+	}
+
+	data, err := json.MarshalIndent(verdicts, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadWithOffsetsTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	file, err := s.files.Open(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to stat file: %v", err), true)
+	}
+	if info.Size() > s.maxFileSize {
+		return s.sendToolResult(id, fmt.Sprintf("File too large: %d bytes exceeds limit of %d bytes", info.Size(), s.maxFileSize), true)
+	}
+
+	width := len(fmt.Sprint(info.Size()))
+	reader := bufio.NewReader(file)
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Contents of %s with byte offsets:\n", path))
+
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if strings.IndexByte(line, 0) >= 0 || !utf8.ValidString(line) {
+				return s.sendToolResult(id, fmt.Sprintf("File is not a text file: %s", path), true)
+			}
+			result.WriteString(fmt.Sprintf("%*d | %s", width, offset, strings.TrimSuffix(line, "\n")))
+			result.WriteString("\n")
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+		}
+	}
+	s.recordAudit("read_with_offsets", s.relativePath(absPath), "", int(offset))
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+type FileFingerprint struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+	CRC32    string `json:"crc32"`
+	Head     string `json:"head"`
+	Tail     string `json:"tail"`
+}
+
+func (s *MCPServer) handleFileFingerprintTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	file, err := s.files.Open(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to open file: %v", err), true)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to stat file: %v", err), true)
+	}
+	if info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Path is a directory: %s", path), true)
+	}
+
+	// Stream the content so the hash costs no more memory than the buffer,
+	// whatever the file size.
+	hasher := crc32.NewIEEE()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	head := make([]byte, 64)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	head = head[:n]
+
+	tail := make([]byte, 64)
+	tailStart := info.Size() - int64(len(tail))
+	if tailStart < 0 {
+		tailStart = 0
+	}
+	n, err = file.ReadAt(tail, tailStart)
+	if err != nil && err != io.EOF {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	tail = tail[:n]
+	s.recordAudit("file_fingerprint", s.relativePath(absPath), "", len(head)+len(tail))
+
+	fingerprint := FileFingerprint{
+		Path:     path,
+		Size:     info.Size(),
+		Modified: info.ModTime().UTC().Format(time.RFC3339Nano),
+		CRC32:    fmt.Sprintf("%08x", hasher.Sum32()),
+		Head:     hex.EncodeToString(head),
+		Tail:     hex.EncodeToString(tail),
+	}
+
+	data, err := json.MarshalIndent(fingerprint, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleFindUnmatchedTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	patterns, err := getStringArrayArg(args, "patterns")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	matchers := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		matchers[i], err = compilePathGlob(pattern)
+		if err != nil {
+			return s.sendError(id, -32602, fmt.Sprintf("Invalid pattern: %s", pattern))
+		}
+	}
+
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	var unmatched []string
+	truncated := false
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		for _, matcher := range matchers {
+			if s.matchesPathGlob(matcher, p) {
+				return nil
+			}
+		}
+
+		if len(unmatched) >= defaultMaxResults {
+			truncated = true
+			return filepath.SkipAll
+		}
+		unmatched = append(unmatched, s.relativePath(p))
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Search failed: %v", err), true)
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Files matching none of %s:\n", strings.Join(patterns, ", ")))
+
+	if len(unmatched) == 0 {
+		result.WriteString("Every file matches at least one pattern.")
+	} else {
+		for _, match := range unmatched {
+			result.WriteString(fmt.Sprintf("📄 %s\n", match))
+		}
+	}
+	if truncated {
+		result.WriteString(fmt.Sprintf("Results truncated after %d files.\n", defaultMaxResults))
+	}
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+type TreeNode struct {
+	ID       int    `json:"id"`
+	ParentID *int   `json:"parentId"`
+	Name     string `json:"name"`
+	IsDir    bool   `json:"isDir"`
+	Size     int64  `json:"size"`
+}
+
+type TreeJSONResult struct {
+	Nodes     []TreeNode `json:"nodes"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleTreeJSONTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	maxDepth, err := getOptionalIntArg(args, "maxDepth", defaultMaxDepth)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if maxDepth < 0 {
+		return s.sendError(id, -32602, "Invalid maxDepth argument: must be non-negative")
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	result := TreeJSONResult{Nodes: []TreeNode{}}
+	ids := make(map[string]int)
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if p != absPath {
+			rel, _ := filepath.Rel(absPath, p)
+			if strings.Count(rel, string(filepath.Separator))+1 > maxDepth {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if len(result.Nodes) >= maxTreeNodes {
+			result.Truncated = true
+			return filepath.SkipAll
+		}
+
+		node := TreeNode{
+			ID:    len(result.Nodes),
+			Name:  d.Name(),
+			IsDir: d.IsDir(),
+		}
+		if p != absPath {
+			parentID := ids[filepath.Dir(p)]
+			node.ParentID = &parentID
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				node.Size = info.Size()
+			}
+		}
+
+		ids[p] = node.ID
+		result.Nodes = append(result.Nodes, node)
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to build tree: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type CompareAndSwapResult struct {
+	Status      string `json:"status"`
+	Path        string `json:"path"`
+	CurrentHash string `json:"currentHash"`
+	Bytes       int    `json:"bytes,omitempty"`
+}
+
+func (s *MCPServer) handleWriteIfUnchangedTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := getStringArg(args, "content")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	expectedHash, err := getStringArg(args, "expectedHash")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// Held from the hash check to the rename, so two callers with the same
+	// expectedHash cannot both write.
+	unlock := s.lockFile(absPath)
+	defer unlock()
+
+	currentHash, err := hashFileSHA256(s.files, absPath)
+	if err != nil && !os.IsNotExist(err) {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	result := CompareAndSwapResult{Path: path, CurrentHash: currentHash}
+	if !strings.EqualFold(currentHash, expectedHash) {
+		result.Status = "conflict"
+		data, _ := json.MarshalIndent(result, "", "  ")
+		return s.sendToolResult(id, string(data), true)
+	}
+
+	if s.dryRun {
+		return s.sendDryRun(id, "write %s to %s%s (its hash matches expectedHash)", formatByteSize(int64(len(content))), path, describeReplaced(s.files, absPath))
+	}
+
+	if err := writeFileAtomic(s.files, absPath, []byte(content), 0644); err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(path)), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to write file: %v", err), true)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	result.Status = "written"
+	result.CurrentHash = hex.EncodeToString(sum[:])
+	result.Bytes = len(content)
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadFirstExistingTool(id interface{}, args map[string]interface{}) error {
+	paths, err := getStringArrayArg(args, "paths")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if len(paths) == 0 {
+		return s.sendError(id, -32602, "Invalid paths argument: must not be empty")
+	}
+
+	// Check every candidate up front so an escaping path is reported even when
+	// an earlier candidate would have matched.
+	absPaths := make([]string, len(paths))
+	for i, path := range paths {
+		absPath, err := s.resolvePath(path)
+		if err != nil {
+			return s.sendError(id, -32602, fmt.Sprintf("%s: %s", err.Error(), path))
+		}
+		absPaths[i] = absPath
+	}
+
+	var tried []string
+	for i, path := range paths {
+		info, err := s.files.Stat(absPaths[i])
+		if err != nil || info.IsDir() {
+			tried = append(tried, path)
+			continue
+		}
+
+		content, err := s.readFileLimited(absPaths[i])
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s (%v)", path, err))
+			continue
+		}
+
+		s.recordAudit("read_first_existing", s.relativePath(absPaths[i]), "", len(content))
+
+		if isBinaryContent(content) {
+			result := fmt.Sprintf("Contents of %s (base64):\n%s", path, base64.StdEncoding.EncodeToString(content))
+			return s.sendToolResult(id, result, false)
+		}
+		result := fmt.Sprintf("Contents of %s:\n%s", path, string(content))
+		return s.sendToolResult(id, result, false)
+	}
+
+	result := fmt.Sprintf("None of the candidate files could be read. Tried:\n%s", strings.Join(tried, "\n"))
+	return s.sendToolResult(id, result, true)
+}
+
+type PermissionFinding struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+type PermissionAudit struct {
+	WorldWritable []PermissionFinding `json:"world_writable"`
+	Setuid        []PermissionFinding `json:"setuid"`
+	Setgid        []PermissionFinding `json:"setgid"`
+	Executable    []PermissionFinding `json:"executable"`
+	Truncated     bool                `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleAuditPermissionsTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// Windows has no POSIX permission bits; Go synthesizes them from the
+	// read-only attribute, so an audit would only produce noise.
+	if runtime.GOOS == "windows" {
+		return s.sendToolResult(id, "Permission audit is not supported on Windows", true)
+	}
+
+	audit := PermissionAudit{
+		WorldWritable: []PermissionFinding{},
+		Setuid:        []PermissionFinding{},
+		Setgid:        []PermissionFinding{},
+		Executable:    []PermissionFinding{},
+	}
+
+	add := func(list *[]PermissionFinding, finding PermissionFinding) {
+		if len(*list) >= defaultMaxResults {
+			audit.Truncated = true
+			return
+		}
+		*list = append(*list, finding)
+	}
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		// Symlinks always report 0777, which says nothing about the target.
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		mode := info.Mode()
+		finding := PermissionFinding{Path: s.relativePath(p), Mode: mode.String()}
+
+		if mode.Perm()&0002 != 0 {
+			add(&audit.WorldWritable, finding)
+		}
+		if mode&fs.ModeSetuid != 0 {
+			add(&audit.Setuid, finding)
+		}
+		if mode&fs.ModeSetgid != 0 {
+			add(&audit.Setgid, finding)
+		}
+		if mode.IsRegular() && mode.Perm()&0111 != 0 {
+			add(&audit.Executable, finding)
+		}
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to audit permissions: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type FilePreview struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	IsBinary bool   `json:"isBinary"`
+	Preview  string `json:"preview"`
+}
+
+type DirectoryPreviews struct {
+	Files     []FilePreview `json:"files"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleDirectoryPreviewsTool(id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	entries, err := s.files.ReadDir(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+	}
+
+	result := DirectoryPreviews{Files: []FilePreview{}}
+	total := 0
+
+	for _, entry := range entries {
+		// Only regular files, or links to them that stay inside the roots;
+		// reading a FIFO or device could block or never end.
+		entryPath := filepath.Join(absPath, entry.Name())
+		if entry.IsDir() || !s.entryAllowed(entryPath, entry) {
+			continue
+		}
+		info, err := s.files.Stat(entryPath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if total >= maxPreviewTotalBytes {
+			result.Truncated = true
+			break
+		}
+
+		preview := FilePreview{Name: entry.Name(), Size: info.Size()}
+
+		sample, err := readFilePrefix(s.files, entryPath, previewBytes)
+		if err != nil {
+			preview.Preview = fmt.Sprintf("(unreadable: %v)", err)
+		} else if isBinaryContent(trimIncompleteRune(sample)) {
+			preview.IsBinary = true
+			preview.Preview = fmt.Sprintf("(binary, %s)", s.detectMimeType(filepath.Ext(entry.Name()), sample))
+		} else {
+			preview.Preview = string(trimIncompleteRune(sample))
+			s.recordAudit("directory_previews", s.relativePath(entryPath), "", len(preview.Preview))
+		}
+
+		total += len(preview.Preview)
+		result.Files = append(result.Files, preview)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type StabilityResult struct {
+	Path     string  `json:"path"`
+	Stable   bool    `json:"stable"`
+	TimedOut bool    `json:"timedOut"`
+	Waited   float64 `json:"waitedSeconds"`
+	Size     int64   `json:"size"`
+	Modified string  `json:"modified,omitempty"`
+}
+
+func (s *MCPServer) handleWaitForStableTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	stableFor, err := getOptionalNumberArg(args, "stableFor", 2)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	timeout, err := getOptionalNumberArg(args, "timeout", 30)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if stableFor <= 0 || timeout <= 0 || timeout > maxWaitSeconds {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid durations: stableFor and timeout must be positive and timeout at most %d seconds", maxWaitSeconds))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	stableDuration := time.Duration(stableFor * float64(time.Second))
+	pollInterval := stableDuration / 4
+	if pollInterval > 250*time.Millisecond {
+		pollInterval = 250 * time.Millisecond
+	}
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(timeout * float64(time.Second)))
+	result := StabilityResult{Path: path, Size: -1}
+
+	var lastSize int64 = -1
+	var lastMod time.Time
+	lastChange := start
+
+	for {
+		info, err := s.files.Stat(absPath)
+		size, mod := int64(-1), time.Time{}
+		if err == nil {
+			size, mod = info.Size(), info.ModTime()
+		}
+
+		now := time.Now()
+		if size != lastSize || !mod.Equal(lastMod) {
+			lastSize, lastMod, lastChange = size, mod, now
+		}
+
+		if size >= 0 && now.Sub(lastChange) >= stableDuration {
+			result.Stable = true
+			break
+		}
+		if now.After(deadline) {
+			result.TimedOut = true
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	result.Waited = time.Since(start).Seconds()
+	result.Size = lastSize
+	if lastSize >= 0 {
+		result.Modified = lastMod.UTC().Format(time.RFC3339Nano)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type TOCDirectory struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Files       int    `json:"files"`
+}
+
+type TOCConfigFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+type ProjectTOC struct {
+	Description string          `json:"description,omitempty"`
+	Directories []TOCDirectory  `json:"directories"`
+	ConfigFiles []TOCConfigFile `json:"configFiles"`
+	FileTypes   map[string]int  `json:"fileTypes"`
+	TotalFiles  int             `json:"totalFiles"`
+	Truncated   bool            `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleProjectTOCTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	entries, err := s.files.ReadDir(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+	}
+
+	toc := ProjectTOC{
+		Description: s.describeDirectory(absPath),
+		Directories: []TOCDirectory{},
+		ConfigFiles: []TOCConfigFile{},
+		FileTypes:   make(map[string]int),
+	}
+
+	dirIndex := make(map[string]int)
+	for _, entry := range entries {
+		entryPath := filepath.Join(absPath, entry.Name())
+		if entry.IsDir() && !isVCSDir(entry.Name()) && s.entryAllowed(entryPath, entry) {
+			dirIndex[entry.Name()] = len(toc.Directories)
+			toc.Directories = append(toc.Directories, TOCDirectory{
+				Name:        entry.Name(),
+				Description: s.describeDirectory(entryPath),
+			})
+		}
+	}
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			if p != absPath && isVCSDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if toc.TotalFiles >= maxTOCFiles {
+			toc.Truncated = true
+			return filepath.SkipAll
+		}
+		toc.TotalFiles++
+
+		rel, _ := filepath.Rel(absPath, p)
+		if top, _, nested := strings.Cut(rel, string(filepath.Separator)); nested {
+			if i, ok := dirIndex[top]; ok {
+				toc.Directories[i].Files++
+			}
+		}
+
+		if kind, ok := projectConfigFiles[d.Name()]; ok && strings.Count(rel, string(filepath.Separator)) < 2 {
+			toc.ConfigFiles = append(toc.ConfigFiles, TOCConfigFile{Path: rel, Kind: kind})
+		}
+
+		ext := strings.ToLower(filepath.Ext(d.Name()))
+		if ext == "" || ext == strings.ToLower(d.Name()) {
+			ext = "(none)"
+		}
+		toc.FileTypes[ext]++
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to scan project: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(toc, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type RestartResult struct {
+	Restarted        bool   `json:"restarted"`
+	ConfigReloaded   bool   `json:"configReloaded"`
+	BaseDir          string `json:"baseDir"`
+	BaseDirAvailable bool   `json:"baseDirAvailable"`
+}
+
+// handleRestart rebuilds the server's state in place without dropping the
+// transport. The -config file is read again and its settings replace the
+// old ones, roots excepted, with command-line flags still winning; a file
+// that does not validate leaves everything as it was. Then the served
+// directory is re-validated (and recreated with -create-dir) and the watcher
+// rebuilt. Restart is not a detached request, so no other ordinary request
+// runs while the settings are swapped.
+func (s *MCPServer) handleRestart(id interface{}) error {
+	slog.Info("Restarting server state")
+
+	if s.configPath != "" {
+		cfg, err := loadConfig(s.configPath)
+		if err == nil {
+			err = cfg.validate(s.createDir)
+		}
+		if err == nil {
+			err = s.applySettings(s.flagSettings.withConfig(cfg, s.setFlags))
+		}
+		if err != nil {
+			return s.sendError(id, -32603, fmt.Sprintf("Restart failed: invalid -config %s: %v", s.configPath, err))
+		}
+	}
+
+	available := s.checkBaseDir()
+	s.baseDirAvailable.Store(available)
+
+	// Subscriptions survive the restart; only the watcher is rebuilt.
+	s.stopWatcher()
+	if err := s.startWatcher(); err != nil {
+		slog.Warn("File watching disabled", "error", err)
+	}
+
+	slog.Info("Server state restarted", "available", available, "config", s.configPath)
+	return s.sendResult(id, RestartResult{
+		Restarted:        true,
+		ConfigReloaded:   s.configPath != "",
+		BaseDir:          s.baseDir,
+		BaseDirAvailable: available,
+	})
+}
+
+type ServerStats struct {
+	StartTime       string       `json:"startTime"`
+	UptimeSeconds   int64        `json:"uptimeSeconds"`
+	RequestsHandled int64        `json:"requestsHandled"`
+	BytesRead       int64        `json:"bytesRead"`
+	Roots           []ConfigRoot `json:"roots"`
+}
+
+// handleStats answers the non-standard server/stats method, which helps
+// check on a deployment. requestsHandled includes this request.
+func (s *MCPServer) handleStats(id interface{}) error {
+	roots := make([]ConfigRoot, len(s.roots))
+	for i, root := range s.roots {
+		roots[i] = ConfigRoot{Name: root.Name, Path: root.Dir}
+	}
+
+	return s.sendResult(id, ServerStats{
+		StartTime:       s.startTime.UTC().Format(time.RFC3339),
+		UptimeSeconds:   int64(time.Since(s.startTime).Seconds()),
+		RequestsHandled: s.requestsHandled.Load(),
+		BytesRead:       s.bytesRead.Load(),
+		Roots:           roots,
+	})
+}
+
+type AuditEntry struct {
+	Time   string      `json:"time"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	URI    string      `json:"uri,omitempty"`
+	Bytes  int         `json:"bytes"`
+	Client *ClientInfo `json:"client,omitempty"`
+}
+
+// recordAudit appends one entry to the audit log when it is enabled. Failures
+// are logged but never fail the read itself.
+func (s *MCPServer) recordAudit(method, path, uri string, n int) {
+	s.bytesRead.Add(int64(n))
+	if s.auditLogPath == "" {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Method: method,
+		Path:   path,
+		URI:    uri,
+		Bytes:  n,
+		Client: s.clientInfo,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Failed to encode audit entry", "error", err)
+		return
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	file, err := os.OpenFile(s.auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Failed to open audit log", "path", s.auditLogPath, "error", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		slog.Error("Failed to write audit log", "path", s.auditLogPath, "error", err)
+	}
+}
+
+func (s *MCPServer) handleReadAuditLogTool(id interface{}, args map[string]interface{}) error {
+	limit, err := getOptionalIntArg(args, "limit", 50)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if limit <= 0 || limit > defaultMaxResults {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid limit argument: must be between 1 and %d", defaultMaxResults))
+	}
+
+	if s.auditLogPath == "" {
+		return s.sendToolResult(id, "Audit logging is not enabled on this server", true)
+	}
+
+	s.auditMu.Lock()
+	file, err := os.Open(s.auditLogPath)
+	s.auditMu.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, "[]", false)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to open audit log: %v", err), true)
+	}
+	defer file.Close()
+
+	// Keep only the newest entries while scanning so memory stays bounded by
+	// the limit rather than the log size.
+	entries := make([]json.RawMessage, 0, limit)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if len(entries) == limit {
+			entries = entries[1:]
+		}
+		entries = append(entries, json.RawMessage(append([]byte(nil), line...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read audit log: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type SecretFinding struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+}
+
+type SecretScanResult struct {
+	Findings     []SecretFinding `json:"findings"`
+	FilesScanned int             `json:"filesScanned"`
+	Truncated    bool            `json:"truncated,omitempty"`
+
+	// Skipped lists entries that could not be read, so a clean result is not
+	// mistaken for a complete one.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func (s *MCPServer) handleScanSecretsTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	result := SecretScanResult{Findings: []SecretFinding{}}
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			if p == absPath {
+				return err
+			}
+			result.Skipped = append(result.Skipped, s.relativePath(p))
+			return nil
+		}
+
+		if d.IsDir() {
+			if p != absPath && isVCSDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || s.isReservedPath(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > s.maxFileSize {
+			return nil
+		}
+
+		findings, err := scanFileForSecrets(s.files, p)
+		if err != nil {
+			result.Skipped = append(result.Skipped, s.relativePath(p))
+			return nil
+		}
+		result.FilesScanned++
+
+		for _, finding := range findings {
+			if len(result.Findings) >= defaultMaxResults {
+				result.Truncated = true
+				return filepath.SkipAll
+			}
+			finding.File = s.relativePath(p)
+			result.Findings = append(result.Findings, finding)
+		}
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Scan failed: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadForReviewTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	startLine, err := getOptionalIntArg(args, "start_line", 1)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	endLine, err := getOptionalIntArg(args, "end_line", 0)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if startLine < 1 || (endLine != 0 && endLine < startLine) {
+		return s.sendError(id, -32602, "Invalid line range: start_line must be at least 1 and end_line must not be before it")
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// A range is streamed by the same bounded reader as read_file, so it
+	// works on files over the size limit; the whole file is read only when
+	// no range is given, to report its line count.
+	ranged := startLine > 1 || endLine != 0
+	var content []byte
+	var first, last int
+	var truncated bool
+	if ranged {
+		content, first, last, truncated, err = readLineRange(s.files, absPath, startLine, endLine, s.maxFileSize)
+	} else {
+		content, err = s.readFileLimited(absPath)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		var tooLarge *FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			return s.sendToolResult(id, fmt.Sprintf("File too large: %s is %d bytes, over the limit of %d bytes; read part of it with start_line/end_line", path, tooLarge.Size, tooLarge.Limit), true)
+		}
+		if ranged && !errors.Is(err, fs.ErrPermission) {
+			return s.sendToolResult(id, fmt.Sprintf("%v in %s", err, path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	if isBinaryContent(content) {
+		return s.sendToolResult(id, fmt.Sprintf("File is not a text file: %s", path), true)
+	}
+	s.recordAudit("read_for_review", s.relativePath(absPath), "", len(content))
+
+	text := strings.TrimSuffix(string(content), "\n")
+	lines := strings.Split(text, "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	var result strings.Builder
+	if ranged {
+		width := len(strconv.Itoa(last))
+		result.WriteString(fmt.Sprintf("%s (lines %d-%d)\n", path, first, last))
+		for i, line := range lines {
+			result.WriteString(fmt.Sprintf("%*d | %s\n", width, first+i, strings.TrimSuffix(line, "\r")))
+		}
+		if truncated {
+			result.WriteString(fmt.Sprintf("(truncated at the %d-byte limit; continue from start_line %d)\n", s.maxFileSize, last))
+		}
+		return s.sendToolResult(id, result.String(), false)
+	}
+
+	if len(lines) == 0 {
+		return s.sendToolResult(id, fmt.Sprintf("%s is empty", path), false)
+	}
+
+	width := len(strconv.Itoa(len(lines)))
+	result.WriteString(fmt.Sprintf("%s (lines 1-%d of %d)\n", path, len(lines), len(lines)))
+	for i, line := range lines {
+		result.WriteString(fmt.Sprintf("%*d | %s\n", width, i+1, strings.TrimSuffix(line, "\r")))
+	}
+
+	return s.sendToolResult(id, result.String(), false)
+}
+
+type DuplicateGroup struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Count  int      `json:"count"`
+	Wasted int64    `json:"wastedBytes"`
+	Paths  []string `json:"paths"`
+}
+
+type DedupReport struct {
+	FilesScanned     int              `json:"filesScanned"`
+	DuplicateGroups  int              `json:"duplicateGroups"`
+	ReclaimableBytes int64            `json:"reclaimableBytes"`
+	TopGroups        []DuplicateGroup `json:"topGroups"`
+}
+
+func (s *MCPServer) handleDedupReportTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	count, err := getOptionalIntArg(args, "count", 20)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if count <= 0 {
+		return s.sendError(id, -32602, "Invalid count argument: must be positive")
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// Only files that share a size can be identical, so group by size first
+	// and hash just those candidates.
+	type candidate struct {
+		path string
+		info os.FileInfo
+	}
+	bySize := make(map[int64][]candidate)
+	report := DedupReport{TopGroups: []DuplicateGroup{}}
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != absPath && isVCSDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || s.isReservedPath(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+
+		report.FilesScanned++
+
+		// Hardlinks already share their data, so they are not reclaimable.
+		for _, c := range bySize[info.Size()] {
+			if os.SameFile(c.info, info) {
+				return nil
+			}
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], candidate{p, info})
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+	}
+
+	var groups []DuplicateGroup
+	for size, candidates := range bySize {
+		if len(candidates) < 2 {
+			continue
+		}
+
+		byHash := make(map[string][]string)
+		for _, c := range candidates {
+			hash, err := hashFileSHA256(s.files, c.path)
+			if err != nil {
+				continue
+			}
+			byHash[hash] = append(byHash[hash], s.relativePath(c.path))
+		}
+
+		for hash, same := range byHash {
+			if len(same) < 2 {
+				continue
+			}
+			sort.Strings(same)
+			groups = append(groups, DuplicateGroup{
+				Hash:   hash,
+				Size:   size,
+				Count:  len(same),
+				Wasted: size * int64(len(same)-1),
+				Paths:  same,
+			})
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+
+	report.DuplicateGroups = len(groups)
+	for _, group := range groups {
+		report.ReclaimableBytes += group.Wasted
+	}
+	if len(groups) > count {
+		groups = groups[:count]
+	}
+	report.TopGroups = append(report.TopGroups, groups...)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type NumberStats struct {
+	Count  int       `json:"count"`
+	Sum    float64   `json:"sum"`
+	Min    *float64  `json:"min,omitempty"`
+	Max    *float64  `json:"max,omitempty"`
+	Mean   *float64  `json:"mean,omitempty"`
+	Values []float64 `json:"values,omitempty"`
+}
+
+func (s *MCPServer) handleReadNumbersTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	statsOnly, err := getOptionalBoolArg(args, "statsOnly", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	s.recordAudit("read_numbers", s.relativePath(absPath), "", len(content))
+
+	values := []float64{}
+	for i, line := range strings.Split(string(content), "\n") {
+		for _, token := range strings.Fields(line) {
+			value, err := strconv.ParseFloat(token, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return s.sendToolResult(id, fmt.Sprintf("Non-numeric token %q on line %d of %s", token, i+1, path), true)
+			}
+			values = append(values, value)
+		}
+	}
+
+	stats := NumberStats{Count: len(values)}
+	if len(values) > 0 {
+		lowest, highest := values[0], values[0]
+		for _, value := range values {
+			stats.Sum += value
+			lowest = math.Min(lowest, value)
+			highest = math.Max(highest, value)
+		}
+		mean := stats.Sum / float64(len(values))
+		stats.Min, stats.Max, stats.Mean = &lowest, &highest, &mean
+	}
+	if !statsOnly {
+		stats.Values = values
+	}
+
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type ReadableFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type ReadableListing struct {
+	Files            []ReadableFile `json:"files"`
+	SkippedBinary    int            `json:"skippedBinary"`
+	SkippedOversized int            `json:"skippedOversized"`
+	Truncated        bool           `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleListReadableTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	listing := ReadableListing{Files: []ReadableFile{}}
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != absPath && (!recursive || isVCSDir(d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || s.isReservedPath(p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.Size() > s.maxFileSize {
+			listing.SkippedOversized++
+			return nil
+		}
+
+		sample, err := readFilePrefix(s.files, p, 8000)
+		if err != nil {
+			return nil
+		}
+		if isBinaryContent(trimIncompleteRune(sample)) {
+			listing.SkippedBinary++
+			return nil
+		}
+
+		if len(listing.Files) >= defaultMaxResults {
+			listing.Truncated = true
+			return filepath.SkipAll
+		}
+
+		mimeType := s.detectFileMimeType(p)
+		if !isTextMimeType(mimeType) {
+			mimeType = "text/plain"
+		}
+
+		listing.Files = append(listing.Files, ReadableFile{
+			Path:     s.relativePath(p),
+			Size:     info.Size(),
+			MimeType: mimeType,
+		})
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(listing, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+type ContentMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type ContentSearchResult struct {
+	Matches      []ContentMatch `json:"matches"`
+	FilesScanned int            `json:"filesScanned"`
+	Truncated    bool           `json:"truncated,omitempty"`
+}
+
+func (s *MCPServer) handleSearchContentTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	query, err := getStringArg(args, "query")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	useRegex, err := getOptionalBoolArg(args, "regex", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	ignoreCase, err := getOptionalBoolArg(args, "ignore_case", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	glob, err := getOptionalStringArg(args, "glob", "")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	maxSize, err := getOptionalIntArg(args, "max_file_size", int(s.maxFileSize))
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if query == "" {
+		return s.sendError(id, -32602, "Invalid query argument: must not be empty")
+	}
+
+	var globMatcher *regexp.Regexp
+	if glob != "" {
+		globMatcher, err = compilePathGlob(glob)
+		if err != nil {
+			return s.sendError(id, -32602, fmt.Sprintf("Invalid glob argument: %v", err))
+		}
+	}
+
+	expr := query
+	if !useRegex {
+		expr = regexp.QuoteMeta(query)
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid regular expression: %v", err))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	result := ContentSearchResult{Matches: []ContentMatch{}}
+	ignore := s.newGitignoreMatcher(absPath)
+	progress := s.progressReporter(ctx)
+
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if skip, err := ignore.skip(p, d, absPath); skip || d.IsDir() {
+			return err
+		}
+
+		if !d.Type().IsRegular() || s.isReservedPath(p) || s.isFilteredOut(p, false) {
+			return nil
+		}
+
+		if globMatcher != nil && !s.matchesPathGlob(globMatcher, p) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() > int64(maxSize) {
+			return nil
+		}
+
+		matched, returned := 0, 0
+		truncated, err := searchFileContent(s.files, p, re, func(line int, text string) bool {
+			if len(result.Matches) >= defaultMaxResults {
+				return false
+			}
+			result.Matches = append(result.Matches, ContentMatch{Path: s.relativePath(p), Line: line, Text: text})
+			matched++
+			returned += len(text)
+			return true
+		})
+		// Only the matching lines leave the server, so only files with
+		// matches are audited, for the bytes of those lines.
+		if matched > 0 {
+			s.recordAudit("search_content", s.relativePath(p), "", returned)
+		}
+		if err != nil {
+			return nil
+		}
+		result.FilesScanned++
+		progress.update(result.FilesScanned)
+
+		if truncated {
+			result.Truncated = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Search failed: %v", err), true)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleDeletePathTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolveLinkPath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.isRootDir(absPath) {
+		return s.sendError(id, -32602, "Access denied: cannot delete the base directory")
+	}
+
+	if err := s.checkRealParent(absPath); err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	info, err := s.files.Lstat(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to access path: %v", err), true)
+	}
+
+	kind := "file"
+	if info.IsDir() {
+		kind = "directory"
+	}
+
+	if s.dryRun {
+		if !info.IsDir() {
+			return s.sendDryRun(id, "delete %s %s (%s)", kind, path, formatByteSize(info.Size()))
+		}
+		stats, err := treeStats(s.files, absPath)
+		if err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+		}
+		if !recursive && stats.files+stats.dirs > 0 {
+			return s.sendToolResult(id, fmt.Sprintf("Directory is not empty: %s (set recursive to delete it)", path), true)
+		}
+		return s.sendDryRun(id, "delete directory %s with %s", path, stats)
+	}
+
+	if info.IsDir() && recursive {
+		err = s.files.RemoveAll(absPath)
+	} else {
+		err = s.files.Remove(absPath)
+	}
+	if err != nil {
+		if info.IsDir() && !recursive {
+			if entries, readErr := s.files.ReadDir(absPath); readErr == nil && len(entries) > 0 {
+				return s.sendToolResult(id, fmt.Sprintf("Directory is not empty: %s (set recursive to delete it)", path), true)
+			}
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to delete %s: %v", kind, err), true)
+	}
+
+	slog.Info("Deleted path", "kind", kind, "path", absPath)
+	return s.sendToolResult(id, fmt.Sprintf("Deleted %s %s", kind, path), false)
+}
+
+func (s *MCPServer) handleMoveFileTool(id interface{}, args map[string]interface{}) error {
+	source, err := getStringArg(args, "source")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	destination, err := getStringArg(args, "destination")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	overwrite, err := getOptionalBoolArg(args, "overwrite", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absSource, err := s.resolveLinkPath(source)
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid source: %v", err))
+	}
+
+	absDest, err := s.resolvePath(destination)
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid destination: %v", err))
+	}
+
+	if s.isRootDir(absSource) || s.isRootDir(absDest) {
+		return s.sendError(id, -32602, "Access denied: cannot move the base directory")
+	}
+
+	if err := s.checkRealParent(absSource); err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid source: %v", err))
+	}
+	if err := s.checkRealParent(absDest); err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid destination: %v", err))
+	}
+
+	if isWithinDir(absSource, absDest) {
+		return s.sendToolResult(id, fmt.Sprintf("Cannot move %s into itself", source), true)
+	}
+
+	info, err := s.files.Lstat(absSource)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", source), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to access path: %v", err), true)
+	}
+
+	if parent, err := s.files.Stat(filepath.Dir(absDest)); err != nil || !parent.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(destination)), true)
+	}
+
+	if _, err := s.files.Lstat(absDest); err == nil && !overwrite {
+		return s.sendToolResult(id, fmt.Sprintf("Destination already exists: %s (set overwrite to replace it)", destination), true)
+	}
+
+	if info.IsDir() {
+		if hidden, err := s.hiddenEntry(context.Background(), absSource); err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+		} else if hidden {
+			return s.sendError(id, -32602, fmt.Sprintf("Access denied: %s contains files hidden by the server", source))
+		}
+	}
+
+	if s.dryRun {
+		return s.sendDryRun(id, "move %s to %s%s", source, destination, describeReplaced(s.files, absDest))
+	}
+
+	err = s.files.Rename(absSource, absDest)
+	if errors.Is(err, syscall.EXDEV) {
+		// Renames cannot cross filesystems, for instance when a
+		// subdirectory is a separate mount; copy the file instead.
+		if !info.Mode().IsRegular() {
+			return s.sendToolResult(id, fmt.Sprintf("Cannot move %s across filesystems: only regular files can be copied", source), true)
+		}
+		err = copyFile(s.files, absSource, absDest)
+		if err == nil {
+			err = s.files.Remove(absSource)
+		}
+	}
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to move %s: %v", source, err), true)
+	}
+
+	slog.Info("Moved path", "from", absSource, "to", absDest)
+	return s.sendToolResult(id, fmt.Sprintf("Moved %s to %s", source, destination), false)
+}
+
+type FileInfo struct {
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	Mode      string `json:"mode"`
+	Modified  string `json:"modified"`
+	IsDir     bool   `json:"isDir"`
+	IsSymlink bool   `json:"isSymlink"`
+	Target    string `json:"target,omitempty"`
+	MimeType  string `json:"mimeType,omitempty"`
+}
+
+func (s *MCPServer) handleFileInfoTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	asJSON, err := getOptionalBoolArg(args, "json", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolveLinkPath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if err := s.checkRealParent(absPath); err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// Lstat so a symlink is described as a link rather than its target.
+	info, err := s.files.Lstat(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to stat path: %v", err), true)
+	}
+
+	result := FileInfo{
+		Path:      path,
+		Size:      info.Size(),
+		Mode:      info.Mode().String(),
+		Modified:  info.ModTime().Format(time.RFC3339),
+		IsDir:     info.IsDir(),
+		IsSymlink: info.Mode()&os.ModeSymlink != 0,
+	}
+
+	switch {
+	case result.IsSymlink:
+		result.Type = "symlink"
+		result.Target, _ = s.files.Readlink(absPath)
+	case result.IsDir:
+		result.Type = "directory"
+	case info.Mode().IsRegular():
+		result.Type = "file"
+		result.MimeType = s.detectFileMimeType(absPath)
+	default:
+		result.Type = "other"
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+		}
+		return s.sendToolResult(id, string(data), false)
+	}
+
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("Path: %s\n", result.Path))
+	text.WriteString(fmt.Sprintf("Type: %s\n", result.Type))
+	text.WriteString(fmt.Sprintf("Size: %d bytes\n", result.Size))
+	text.WriteString(fmt.Sprintf("Mode: %s\n", result.Mode))
+	text.WriteString(fmt.Sprintf("Modified: %s\n", result.Modified))
+	if result.Target != "" {
+		text.WriteString(fmt.Sprintf("Target: %s\n", result.Target))
+	}
+	if result.MimeType != "" {
+		text.WriteString(fmt.Sprintf("MIME type: %s\n", result.MimeType))
+	}
+
+	return s.sendToolResult(id, text.String(), false)
+}
+
+func (s *MCPServer) handleCreateDirectoryTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// MkdirAll follows symlinks in the existing part of the path, so that
+	// part must resolve inside a root as well.
+	resolved, err := evalSymlinksPartial(s.files, absPath)
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to resolve path: %v", err), true)
+	}
+	if _, ok := s.realRelativePath(resolved); !ok {
+		return s.sendError(id, -32602, "Access denied: path outside allowed directory")
+	}
+
+	relPath := s.relativePath(absPath)
+
+	if info, err := s.files.Stat(absPath); err == nil {
+		if !info.IsDir() {
+			return s.sendToolResult(id, fmt.Sprintf("Path exists and is not a directory: %s", relPath), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Directory already exists: %s", relPath), false)
+	}
+
+	if s.dryRun {
+		var missing []string
+		for dir := absPath; !s.isRootDir(dir); dir = filepath.Dir(dir) {
+			if _, err := s.files.Stat(dir); err == nil {
+				break
+			}
+			missing = append([]string{s.relativePath(dir)}, missing...)
+		}
+		return s.sendDryRun(id, "create directories %s", strings.Join(missing, ", "))
+	}
+
+	if err := s.files.MkdirAll(absPath, 0755); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to create directory: %v", err), true)
+	}
+
+	slog.Info("Created directory", "path", absPath)
+	return s.sendToolResult(id, fmt.Sprintf("Created directory %s", relPath), false)
+}
+
+func (s *MCPServer) handleCopyFileTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	source, err := getStringArg(args, "source")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	destination, err := getStringArg(args, "destination")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	recursive, err := getOptionalBoolArg(args, "recursive", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	overwrite, err := getOptionalBoolArg(args, "overwrite", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absSource, err := s.resolvePath(source)
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid source: %v", err))
+	}
+
+	absDest, err := s.resolvePath(destination)
+	if err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid destination: %v", err))
+	}
+
+	if err := s.checkRealParent(absDest); err != nil {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid destination: %v", err))
+	}
+
+	// Copy what a symlinked source points at; resolvePath has already
+	// checked that it stays inside a root.
+	realSource, err := s.files.EvalSymlinks(absSource)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Path not found: %s", source), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to resolve source: %v", err), true)
+	}
+
+	info, err := s.files.Stat(realSource)
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to access path: %v", err), true)
+	}
+
+	if info.IsDir() && !recursive {
+		return s.sendToolResult(id, fmt.Sprintf("%s is a directory (set recursive to copy it)", source), true)
+	}
+
+	if absSource == absDest || (info.IsDir() && isWithinDir(absSource, absDest)) {
+		return s.sendToolResult(id, fmt.Sprintf("Cannot copy %s into itself", source), true)
+	}
+
+	if parent, err := s.files.Stat(filepath.Dir(absDest)); err != nil || !parent.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(destination)), true)
+	}
+
+	if destInfo, err := s.files.Lstat(absDest); err == nil {
+		if !overwrite {
+			return s.sendToolResult(id, fmt.Sprintf("Destination already exists: %s (set overwrite to replace it)", destination), true)
+		}
+		if destInfo.IsDir() != info.IsDir() {
+			return s.sendToolResult(id, fmt.Sprintf("Cannot overwrite %s: one of source and destination is a directory and the other is not", destination), true)
+		}
+	}
+
+	if info.IsDir() {
+		if hidden, err := s.hiddenEntry(ctx, realSource); err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+		} else if hidden {
+			return s.sendError(id, -32602, fmt.Sprintf("Access denied: %s contains files hidden by the server", source))
+		}
+	}
+
+	if s.dryRun {
+		if !info.IsDir() {
+			return s.sendDryRun(id, "copy %s (%s) to %s%s", source, formatByteSize(info.Size()), destination, describeReplaced(s.files, absDest))
+		}
+		stats, err := treeStats(s.files, realSource)
+		if err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+		}
+		return s.sendDryRun(id, "copy directory %s with %s to %s%s", source, stats, destination, describeReplaced(s.files, absDest))
+	}
+
+	if !info.IsDir() {
+		if err := copyFile(s.files, realSource, absDest); err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to copy %s: %v", source, err), true)
+		}
+		slog.Info("Copied file", "from", absSource, "to", absDest)
+		return s.sendToolResult(id, fmt.Sprintf("Copied %s to %s", source, destination), false)
+	}
+
+	files, err := copyTree(ctx, s.files, realSource, absDest, overwrite)
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to copy %s after %d files: %v", source, files, err), true)
+	}
+
+	slog.Info("Copied directory", "from", absSource, "to", absDest, "files", files)
+	return s.sendToolResult(id, fmt.Sprintf("Copied %s to %s (%d files)", source, destination, files), false)
+}
+
+func (s *MCPServer) handleFileHashTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	algorithm, err := getOptionalStringArg(args, "algorithm", "sha256")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return s.sendError(id, -32602, fmt.Sprintf("Unsupported algorithm: %s (use md5, sha1 or sha256)", algorithm))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	f, err := s.files.Open(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Path is a directory: %s", path), true)
+	}
+
+	// Stream the file so large files don't need to fit in memory; the size
+	// limit only applies to tools that return file content.
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	return s.sendToolResult(id, fmt.Sprintf("%s:%s", algorithm, hex.EncodeToString(h.Sum(nil))), false)
+}
+
+func (s *MCPServer) handlePreviewFileTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	lines, err := getOptionalIntArg(args, "lines", 10)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if lines < 1 {
+		return s.sendError(id, -32602, "lines must be at least 1")
+	}
+
+	from, err := getOptionalStringArg(args, "from", "head")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if from != "head" && from != "tail" {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid from: %s (use head or tail)", from))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if info, err := s.files.Stat(absPath); err == nil && info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Path is a directory: %s", path), true)
+	}
+
+	var content []byte
+	var total int
+	if from == "head" {
+		content, total, err = readHeadLines(s.files, absPath, lines, s.maxFileSize)
+	} else {
+		content, total, err = readTailLines(s.files, absPath, lines, s.maxFileSize)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		var tooLarge *FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			return s.sendToolResult(id, fmt.Sprintf("Preview too large: %d lines of %s exceed the limit of %d bytes; ask for fewer lines", lines, path, tooLarge.Limit), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	if isBinaryFile(s.files, absPath) {
+		return s.sendToolResult(id, fmt.Sprintf("Cannot preview binary file: %s", path), true)
+	}
+
+	s.recordAudit("preview_file", s.relativePath(absPath), "", len(content))
+
+	shown := countLines(content)
+	position := "First"
+	if from == "tail" {
+		position = "Last"
+	}
+	header := fmt.Sprintf("%s %d lines of %s", position, shown, path)
+	if total >= 0 {
+		header += fmt.Sprintf(" (%d lines total)", total)
+	}
+
+	return s.sendToolResult(id, fmt.Sprintf("%s:\n%s", header, content), false)
+}
+
+func (s *MCPServer) handleAppendFileTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	content, err := getStringArg(args, "content")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	createParents, err := getOptionalBoolArg(args, "create_parents", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if s.dryRun {
+		if info, err := s.files.Stat(filepath.Dir(absPath)); (err != nil || !info.IsDir()) && !createParents {
+			return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(path)), true)
+		}
+		action := "create it"
+		if info, err := s.files.Stat(absPath); err == nil {
+			action = fmt.Sprintf("grow it from %s", formatByteSize(info.Size()))
+		}
+		return s.sendDryRun(id, "append %s to %s (%s)", formatByteSize(int64(len(content))), path, action)
+	}
+
+	if createParents {
+		if err := s.files.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+			return s.sendToolResult(id, fmt.Sprintf("Failed to create parent directories: %v", err), true)
+		}
+	} else if info, err := s.files.Stat(filepath.Dir(absPath)); err != nil || !info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Parent directory does not exist: %s", filepath.Dir(path)), true)
+	}
+
+	unlock := s.lockFile(absPath)
+	defer unlock()
+	if err := s.files.AppendFile(absPath, []byte(content), 0644); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to append to file: %v", err), true)
+	}
+
+	info, err := s.files.Stat(absPath)
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to stat file: %v", err), true)
+	}
+
+	slog.Info("Appended to file", "path", absPath, "bytes", len(content), "size", info.Size())
+	return s.sendToolResult(id, fmt.Sprintf("Appended %d bytes to %s (now %d bytes)", len(content), path, info.Size()), false)
+}
+
+type WatchFileResult struct {
+	Path     string  `json:"path"`
+	Event    string  `json:"event"`
+	Waited   float64 `json:"waitedSeconds"`
+	Size     int64   `json:"size"`
+	Modified string  `json:"modified,omitempty"`
+}
+
+func (s *MCPServer) handleWatchFileTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	timeout, err := getOptionalNumberArg(args, "timeout_seconds", 30)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if timeout <= 0 || timeout > maxWaitSeconds {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid timeout_seconds: must be positive and at most %d", maxWaitSeconds))
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	// Watch the parent directory rather than the file so that creation,
+	// deletion and replacement by rename are all seen. If no watcher can be
+	// set up, the poll ticker alone notices changes.
+	var events <-chan fsnotify.Event
+	pollInterval := watchFilePollInterval
+	if watcher, err := fsnotify.NewWatcher(); err == nil {
+		defer watcher.Close()
+		if err := watcher.Add(filepath.Dir(absPath)); err == nil {
+			events = watcher.Events
+			pollInterval = watchFileSafetyInterval
+		} else {
+			slog.Debug("Falling back to polling for watch_file", "path", absPath, "error", err)
+		}
+	}
+
+	start := time.Now()
+	initial := statFileState(s.files, absPath)
+	timer := time.NewTimer(time.Duration(timeout * float64(time.Second)))
+	defer timer.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	result := WatchFileResult{Path: path, Event: "timeout"}
+	current := initial
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			break wait
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != absPath {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		current = statFileState(s.files, absPath)
+		if event := initial.change(current); event != "" {
+			result.Event = event
+			break
+		}
+	}
+
+	result.Waited = time.Since(start).Seconds()
+	result.Size = current.size
+	if current.exists {
+		result.Modified = current.modTime.UTC().Format(time.RFC3339Nano)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleEditFileTool(id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	search, err := getStringArg(args, "search")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if search == "" {
+		return s.sendError(id, -32602, "Invalid search argument: must not be empty")
+	}
+
+	replace, err := getStringArg(args, "replace")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	all, err := getOptionalBoolArg(args, "all", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	useRegex, err := getOptionalBoolArg(args, "regex", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	var re *regexp.Regexp
+	if useRegex {
+		if re, err = regexp.Compile(search); err != nil {
+			return s.sendError(id, -32602, fmt.Sprintf("Invalid regex: %v", err))
+		}
+	}
+
+	if s.readOnly {
+		return s.sendToolResult(id, readOnlyMessage, true)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	unlock := s.lockFile(absPath)
+	defer unlock()
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		var tooLarge *FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			return s.sendToolResult(id, fmt.Sprintf("File too large: %s is %d bytes, over the limit of %d bytes", path, tooLarge.Size, tooLarge.Limit), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+
+	var edited []byte
+	var count int
+	if re != nil {
+		edited, count = replaceRegexp(content, re, []byte(replace), all)
+	} else {
+		edited, count = replaceLiteral(content, []byte(search), []byte(replace), all)
+	}
+
+	if count == 0 {
+		return s.sendToolResult(id, fmt.Sprintf("Search text not found in %s; the file was not modified", path), true)
+	}
+
+	if s.dryRun {
+		return s.sendDryRun(id, "make %d replacement(s) in %s, changing its size from %s to %s", count, path, formatByteSize(int64(len(content))), formatByteSize(int64(len(edited))))
+	}
+
+	if err := writeFileAtomic(s.files, absPath, edited, 0644); err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to write file: %v", err), true)
+	}
+
+	slog.Info("Edited file", "path", absPath, "replacements", count)
+	return s.sendToolResult(id, fmt.Sprintf("Made %d replacement(s) in %s", count, path), false)
+}
+
+type DirectorySizeResult struct {
+	Path        string `json:"path"`
+	TotalBytes  int64  `json:"totalBytes"`
+	HumanSize   string `json:"humanSize,omitempty"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+}
+
+func (s *MCPServer) handleDirectorySizeTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	human, err := getOptionalBoolArg(args, "human", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	if info, err := s.files.Stat(absPath); err == nil && !info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Not a directory: %s", path), true)
+	}
+
+	progress := s.progressReporter(ctx)
+	result := DirectorySizeResult{Path: path}
+
+	// WalkDir never follows symlinks, and they are not counted either, so
+	// linked files are not counted twice and link cycles cannot loop.
+	err = s.walkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if p == absPath {
+			return nil
+		}
+		if d.IsDir() {
+			result.Directories++
+			return nil
+		}
+		if !d.Type().IsRegular() || s.isReservedPath(p) || s.isFilteredOut(p, false) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		result.TotalBytes += info.Size()
+		result.Files++
+		progress.update(result.Files)
+		return nil
+	})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to scan directory: %v", err), true)
+	}
+
+	if human {
+		result.HumanSize = formatByteSize(result.TotalBytes)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+
+	return s.sendToolResult(id, string(data), false)
+}
+
+func (s *MCPServer) handleReadFilesTool(id interface{}, args map[string]interface{}) error {
+	paths, err := getStringArrayArg(args, "paths")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if len(paths) == 0 {
+		return s.sendError(id, -32602, "Invalid paths argument: must not be empty")
+	}
+	if len(paths) > maxReadFiles {
+		return s.sendError(id, -32602, fmt.Sprintf("Invalid paths argument: at most %d files per call", maxReadFiles))
+	}
+
+	// The whole batch shares the budget of a single read_file.
+	remaining := s.maxFileSize
+	content := make([]ToolContent, 0, len(paths))
+	read := 0
+	for _, path := range paths {
+		text, n, err := s.readBatchFile(path, remaining)
+		if err != nil {
+			text = fmt.Sprintf("Error reading %s: %v", path, err)
+		} else {
+			remaining -= n
+			read++
+		}
+		content = append(content, ToolContent{Type: "text", Text: text})
+	}
+
+	slog.Info("Read files", "requested", len(paths), "read", read, "bytes", s.maxFileSize-remaining)
+	return s.sendResult(id, CallToolResult{Content: content, IsError: read == 0})
+}
+
+// readBatchFile reads one read_files entry, refusing it when it would take
+// more than remaining bytes. It returns the labelled block and the number of
+// bytes read.
+func (s *MCPServer) readBatchFile(path string, remaining int64) (string, int64, error) {
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	info, err := s.files.Stat(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, errors.New("file not found")
+		}
+		return "", 0, err
+	}
+	if info.IsDir() {
+		return "", 0, errors.New("path is a directory")
+	}
+	if info.Size() > remaining {
+		return "", 0, fmt.Errorf("%d bytes would exceed the remaining %d bytes of the %d byte limit for this call", info.Size(), remaining, s.maxFileSize)
+	}
+
+	content, err := s.readFileLimited(absPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if int64(len(content)) > remaining {
+		return "", 0, fmt.Errorf("%d bytes would exceed the remaining %d bytes of the %d byte limit for this call", len(content), remaining, s.maxFileSize)
+	}
+
+	s.recordAudit("read_files", s.relativePath(absPath), "", len(content))
+
+	if isBinaryContent(content) {
+		return fmt.Sprintf("Contents of %s (base64):\n%s", path, base64.StdEncoding.EncodeToString(content)), int64(len(content)), nil
+	}
+	return fmt.Sprintf("Contents of %s:\n%s", path, content), int64(len(content)), nil
+}
+
+func (s *MCPServer) handleGetTreeTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getOptionalStringArg(args, "path", ".")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	maxDepth, err := getOptionalIntArg(args, "max_depth", defaultMaxDepth)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+	if maxDepth < 1 {
+		return s.sendError(id, -32602, "Invalid max_depth argument: must be at least 1")
+	}
+
+	dirsOnly, err := getOptionalBoolArg(args, "dirs_only", false)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	tree := &treePrinter{s: s, ctx: ctx, dirsOnly: dirsOnly, maxDepth: maxDepth}
+
+	// With several roots the top level is the list of roots themselves.
+	if len(s.roots) > 1 && filepath.Clean(path) == "." {
+		tree.b.WriteString(".\n")
+		for i, root := range s.roots {
+			tree.ignore = s.newGitignoreMatcher(root.Dir)
+			tree.dirs++
+			connector, childPrefix := treeBranch(i == len(s.roots)-1)
+			tree.b.WriteString(connector + root.Name + "/\n")
+			if maxDepth > 1 {
+				if err := tree.walk(root.Dir, childPrefix, 2); err != nil && ctx.Err() != nil {
+					return err
+				}
+			}
+		}
+		return s.sendToolResult(id, tree.String(), false)
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	info, err := s.files.Stat(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to access directory: %v", err), true)
+	}
+	if !info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Not a directory: %s", path), true)
+	}
+
+	tree.ignore = s.newGitignoreMatcher(absPath)
+	tree.b.WriteString(s.relativePath(absPath) + "\n")
+	if err := tree.walk(absPath, "", 1); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read directory: %v", err), true)
+	}
+
+	slog.Info("Rendered tree", "path", absPath, "dirs", tree.dirs, "files", tree.files, "truncated", tree.truncated)
+	return s.sendToolResult(id, tree.String(), false)
+}
+
+// treePrinter renders get_tree output. The maxTreeNodes budget is shared by
+// the whole tree.
+type treePrinter struct {
+	s         *MCPServer
+	ctx       context.Context
+	ignore    *gitignoreMatcher
+	dirsOnly  bool
+	maxDepth  int
+	b         strings.Builder
+	dirs      int
+	files     int
+	truncated bool
+}
+
+// walk writes the entries of dir, whose lines start with prefix, descending
+// while depth < maxDepth. Subdirectories that cannot be read are shown
+// without contents.
+func (t *treePrinter) walk(dir, prefix string, depth int) error {
+	entries, err := t.s.files.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		entryPath := filepath.Join(dir, entry.Name())
+		return (t.dirsOnly && !entry.IsDir()) ||
+			(entry.IsDir() && isVCSDir(entry.Name())) ||
+			t.s.isReservedPath(entryPath) ||
+			t.s.isFilteredOut(entryPath, entry.IsDir()) ||
+			t.ignore.ignored(entryPath, entry.IsDir())
+	})
+
+	for i, entry := range entries {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		if t.dirs+t.files >= maxTreeNodes {
+			t.truncated = true
+			return nil
+		}
+
+		connector, childPrefix := treeBranch(i == len(entries)-1)
+		if !entry.IsDir() {
+			t.files++
+			t.b.WriteString(prefix + connector + entry.Name() + "\n")
+			continue
+		}
+
+		t.dirs++
+		t.b.WriteString(prefix + connector + entry.Name() + "/\n")
+		if depth < t.maxDepth {
+			if err := t.walk(filepath.Join(dir, entry.Name()), prefix+childPrefix, depth+1); err != nil && t.ctx.Err() != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String finishes the tree with a tree(1) style summary line.
+func (t *treePrinter) String() string {
+	summary := fmt.Sprintf("\n%d directories", t.dirs)
+	if !t.dirsOnly {
+		summary += fmt.Sprintf(", %d files", t.files)
+	}
+	if t.truncated {
+		summary += fmt.Sprintf(" (truncated after %d entries; lower max_depth or pick a subdirectory)", maxTreeNodes)
+	}
+	return t.b.String() + summary + "\n"
+}
+
+// treeBranch returns the connector for an entry and the prefix its children
+// continue with, depending on whether it is the last in its directory.
+func treeBranch(last bool) (string, string) {
+	if last {
+		return "└── ", "    "
+	}
+	return "├── ", "│   "
+}
+
+// FileStats is the result of file_stats.
+type FileStats struct {
+	Path  string `json:"path"`
+	Lines int64  `json:"lines"`
+	Words int64  `json:"words"`
+	Chars int64  `json:"chars"`
+	Bytes int64  `json:"bytes"`
+
+	// LineEndings is lf, crlf, mixed or none.
+	LineEndings string `json:"lineEndings"`
+
+	// Encoding is ascii, utf-8, utf-8-bom, utf-16le, utf-16be or unknown
+	// when the content is not valid in any of them.
+	Encoding string `json:"encoding"`
+}
+
+func (s *MCPServer) handleFileStatsTool(ctx context.Context, id interface{}, args map[string]interface{}) error {
+	path, err := getStringArg(args, "path")
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	absPath, err := s.resolvePath(path)
+	if err != nil {
+		return s.sendError(id, -32602, err.Error())
+	}
+
+	f, err := s.files.Open(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.sendToolResult(id, fmt.Sprintf("File not found: %s", path), true)
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return s.sendToolResult(id, fmt.Sprintf("Path is a directory: %s", path), true)
+	}
+
+	// Like file_hash this streams the file, so there is no size limit.
+	stats, err := countFileStats(ctx, f)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.sendToolResult(id, fmt.Sprintf("Failed to read file: %v", err), true)
+	}
+	stats.Path = path
+
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return s.sendToolResult(id, fmt.Sprintf("Failed to encode result: %v", err), true)
+	}
+	return s.sendToolResult(id, string(data), false)
+}
+
+// handleMessage dispatches one message. ctx is cancelled when the client
+// sends notifications/cancelled for the request or the server shuts down,
+// and carries the request's progress token if it has one.
+func (s *MCPServer) handleMessage(ctx context.Context, msg JSONRPCMessage) error {
+	if token := progressTokenFromParams(msg.Params); token != nil {
+		ctx = context.WithValue(ctx, progressTokenKey{}, token)
+	}
+
+	if msg.JSONRPC != "2.0" {
+		return s.sendError(msg.ID, -32600, fmt.Sprintf("Invalid Request: unsupported jsonrpc version %q", msg.JSONRPC))
+	}
+	if msg.ID != nil {
+		s.requestsHandled.Add(1)
+	}
+
+	if s.requireDir && !s.baseDirAvailable.Load() && msg.Method != "initialize" && msg.Method != "ping" && !strings.HasPrefix(msg.Method, "notifications/") {
+		return s.sendError(msg.ID, -32603, fmt.Sprintf("Served directory is unavailable: %s", s.rootDirList()))
+	}
+
+	switch msg.Method {
+	case "initialize":
+		var params InitializeParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid initialize parameters")
+		}
+		return s.handleInitialize(msg.ID, params)
+
+	case "notifications/initialized":
+		s.handleNotificationInitialized()
+		return nil
+
+	case "ping":
+		return s.sendResult(msg.ID, struct{}{})
+
+	case "notifications/cancelled":
+		s.handleCancelled(msg.Params)
+		return nil
+
+	case "resources/list":
+		return s.handleListResources(ctx, msg.ID)
+
+	case "resources/templates/list":
+		return s.handleListResourceTemplates(msg.ID)
+
+	case "resources/read":
+		var params ReadResourceParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid read resource parameters")
+		}
+		return s.handleReadResource(ctx, msg.ID, params)
+
+	case "resources/subscribe", "resources/unsubscribe":
+		var params SubscribeParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid subscribe parameters")
+		}
+		return s.handleSubscribe(msg.ID, params, msg.Method == "resources/subscribe")
+
+	case "tools/list":
+		var params ListToolsParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid list tools parameters")
+		}
+		return s.handleListTools(msg.ID, params)
+
+	case "logging/setLevel":
+		var params SetLevelParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid setLevel parameters")
+		}
+		return s.handleSetLevel(msg.ID, params)
+
+	case "server/restart":
+		if !s.allowControl {
+			return s.sendError(msg.ID, -32601, fmt.Sprintf("Method not found: %s", msg.Method))
+		}
+		return s.handleRestart(msg.ID)
+
+	case "server/stats":
+		if s.noStats {
+			return s.sendError(msg.ID, -32601, fmt.Sprintf("Method not found: %s", msg.Method))
+		}
+		return s.handleStats(msg.ID)
+
+	case "tools/call":
+		var params CallToolParams
+		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
+			return s.sendError(msg.ID, -32602, "Invalid call tool parameters")
+		}
+		return s.handleCallTool(ctx, msg.ID, params)
+
+	default:
+		return s.sendError(msg.ID, -32601, fmt.Sprintf("Method not found: %s", msg.Method))
+	}
+}
+
+// startServices starts the background work shared by every transport and
+// returns a function that stops it. Work that outlives a single call stops
+// when ctx is cancelled.
+func (s *MCPServer) startServices(ctx context.Context) func() {
+	for _, root := range s.roots {
+		slog.Info("MCP Server starting", "dir", root.Dir, "root", root.Name)
+	}
+	if s.requireDir {
+		s.baseDirAvailable.Store(s.checkBaseDir())
+		go s.watchBaseDir(ctx, baseDirCheckInterval)
+	}
+
+	if err := s.startWatcher(); err != nil {
+		slog.Warn("File watching disabled", "error", err)
+	}
+	return s.stopWatcher
+}
+
+// scannedMessage is one message read from stdin, or a marker for one that
+// was discarded for exceeding the size limit.
+type scannedMessage struct {
+	line      string
+	oversized bool
+}
+
+// queuedRequest is a message waiting for the request worker, with the
+// context it will be handled under.
+type queuedRequest struct {
+	msg  JSONRPCMessage
+	ctx  context.Context
+	done func()
+}
+
+// runRequest handles a queued request and releases it.
+func (s *MCPServer) runRequest(req queuedRequest) {
+	defer req.done()
+	err := s.handleMessage(req.ctx, req.msg)
+	if err != nil && req.ctx.Err() != nil {
+		slog.Debug("Request cancelled", "id", req.msg.ID, "method", req.msg.Method)
+	} else if err != nil {
+		slog.Error("Error handling message", "method", req.msg.Method, "error", err)
+	}
+}
+
+// detachedTools block until something happens on disk, so they run on
+// their own goroutine instead of holding up the requests queued behind them.
+var detachedTools = map[string]bool{
+	"watch_file":      true,
+	"wait_for_stable": true,
+}
+
+// mutatingTools change the filesystem, and are withheld in read-only mode.
+var mutatingTools = map[string]bool{
+	"write_file":         true,
+	"write_if_unchanged": true,
+	"edit_file":          true,
+	"append_file":        true,
+	"create_directory":   true,
+	"copy_file":          true,
+	"move_file":          true,
+	"delete_path":        true,
+}
+
+// toolEnabled reports whether a tool is listed and callable under the
+// -enable-tools, -disable-tools and -read-only settings.
+func (s *MCPServer) toolEnabled(name string) bool {
+	if s.enabledTools != nil && !s.enabledTools[name] {
+		return false
+	}
+	return !s.disabledTools[name] && !(s.readOnly && mutatingTools[name])
+}
+
+// parseToolList turns a comma-separated -enable-tools or -disable-tools value
+// into a set, rejecting names of tools that do not exist.
+func parseToolList(names []string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, tool := range toolDefinitions() {
+		known[tool.Name] = true
+	}
+
+	set := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown tool %q", name)
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+// isDetachedRequest reports whether msg calls one of detachedTools.
+func isDetachedRequest(msg JSONRPCMessage) bool {
+	if msg.Method != "tools/call" {
+		return false
+	}
+	params, ok := msg.Params.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	name, _ := params["name"].(string)
+	return detachedTools[name]
+}
+
+// requestQueueSize bounds how many messages may wait behind a slow request
+// before reading stdin, and so noticing cancellations, stalls.
+const requestQueueSize = 1024
+
+// Run serves stdio until stdin closes or ctx is cancelled.
+func (s *MCPServer) Run(ctx context.Context) error {
+	stop := s.startServices(ctx)
+	defer stop()
+
+	slog.Info("Server ready, waiting for messages")
+	return s.serveStream(ctx, os.Stdin, os.Stdout)
+}
+
+// serveStream serves one JSON-RPC stream, stdio or a socket connection,
+// until in ends or ctx is cancelled. Messages are read on a separate
+// goroutine so that cancellation is noticed between messages even while
+// waiting for input, and handled in order on a worker goroutine so that
+// notifications/cancelled can reach a request that is still running.
+// Detached requests such as watch_file get a goroutine of their own.
+func (s *MCPServer) serveStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	// The scanner needs room for the largest message plus the header block.
+	// Both stay local: the reader goroutine can outlive a cancelled stream,
+	// and must not share them with the next connection's.
+	splitter := &messageSplitter{maxSize: s.maxMessageSize}
+	scanner := bufio.NewScanner(in)
+	scanner.Split(splitter.split)
+	scanner.Buffer(make([]byte, 0, 64*1024), s.maxMessageSize+maxHeaderBlockSize)
+
+	s.writeMu.Lock()
+	s.out = bufio.NewWriter(out)
+	s.writeMu.Unlock()
+
+	messages := make(chan scannedMessage)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		for scanner.Scan() {
+			msg := scannedMessage{line: scanner.Text()}
+			if splitter.oversized {
+				splitter.oversized = false
+				msg.oversized = true
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	queue := make(chan queuedRequest, requestQueueSize)
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		// Detached requests can run for minutes, so once the stream ends
+		// they are cancelled rather than waited out.
+		streamCtx, endStream := context.WithCancel(context.Background())
+		var detached sync.WaitGroup
+		defer detached.Wait()
+		defer endStream()
+		for req := range queue {
+			// Requests cancelled while still queued are skipped outright.
+			if req.ctx.Err() != nil {
+				req.done()
+				continue
+			}
+			if isDetachedRequest(req.msg) {
+				reqCtx, cancel := context.WithCancel(req.ctx)
+				stop := context.AfterFunc(streamCtx, cancel)
+				req.ctx = reqCtx
+				detached.Add(1)
+				go func() {
+					defer detached.Done()
+					defer stop()
+					defer cancel()
+					s.runRequest(req)
+				}()
+				continue
+			}
+			s.runRequest(req)
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-workerDone
+	}()
+
+	for {
+		var scanned scannedMessage
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down", "reason", context.Cause(ctx))
+			return nil
+		case m, ok := <-messages:
+			if !ok {
+				if err := <-scanErr; err != nil {
+					return fmt.Errorf("scanner error: %v", err)
+				}
+				return nil
+			}
+			scanned = m
+		}
+
+		if scanned.oversized {
+			slog.Warn("Discarded oversized message", "limit", s.maxMessageSize)
+			s.sendError(nil, -32600, fmt.Sprintf("Invalid Request: message exceeds maximum size of %d bytes", s.maxMessageSize))
+			continue
+		}
+
+		line := scanned.line
+		if line == "" {
+			continue
+		}
+
+		slog.Debug("Received message", "message", line)
+
+		var msg JSONRPCMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			slog.Error("Invalid JSON", "error", err)
+			s.sendError(nil, -32700, "Parse error")
+			continue
+		}
+
+		if msg.Method == "notifications/cancelled" {
+			s.handleCancelled(msg.Params)
+			continue
+		}
+
+		reqCtx, done := s.beginRequest(ctx, msg.ID)
+		queue <- queuedRequest{msg: msg, ctx: reqCtx, done: done}
+	}
+}
+
+// messageSplitter provides a bufio.SplitFunc that yields one JSON-RPC
+// message per token. Messages starting with a header block (LSP style
+// Content-Length framing) yield exactly Content-Length body bytes; anything
+// else is read as newline-delimited JSON.
+//
+// A message larger than maxSize is skipped instead of failing the scanner:
+// split returns an empty token with oversized set, then silently consumes
+// the rest of that message.
+type messageSplitter struct {
+	maxSize   int
+	oversized bool
+
+	// discarding is set while the remainder of an oversized message is being
+	// skipped; discardBytes holds how much is left for header framing, or -1
+	// to skip up to the next newline.
+	discarding   bool
+	discardBytes int
+}
+
+func (m *messageSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if m.discarding {
+		return m.discard(data, atEOF)
+	}
+
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if !hasHeaderPrefix(data) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= m.maxSize {
+			m.discarding, m.discardBytes = true, -1
+			return m.skipOversized(data, atEOF)
+		}
+		if len(token) > m.maxSize {
+			m.oversized = true
+			return advance, []byte{}, nil
+		}
+		return advance, token, err
+	}
+
+	headerEnd, sepLen := bytes.Index(data, []byte("\r\n\r\n")), 4
+	if headerEnd < 0 {
+		headerEnd, sepLen = bytes.Index(data, []byte("\n\n")), 2
+	}
+	if headerEnd < 0 {
+		if atEOF || len(data) >= maxHeaderBlockSize {
+			return 0, nil, fmt.Errorf("incomplete message header")
+		}
+		return 0, nil, nil
+	}
+
+	contentLength := -1
+	for _, line := range strings.Split(string(data[:headerEnd]), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n < 0 {
+				return 0, nil, fmt.Errorf("invalid Content-Length header: %q", value)
+			}
+			contentLength = n
+		}
+	}
+	if contentLength < 0 {
+		return 0, nil, fmt.Errorf("message header without Content-Length")
+	}
+
+	bodyStart := headerEnd + sepLen
+	if contentLength > m.maxSize {
+		m.discarding, m.discardBytes = true, bodyStart+contentLength
+		return m.skipOversized(data, atEOF)
+	}
+
+	if len(data) < bodyStart+contentLength {
+		if atEOF {
+			return 0, nil, fmt.Errorf("message body shorter than Content-Length")
+		}
+		return 0, nil, nil
+	}
+
+	return bodyStart + contentLength, data[bodyStart : bodyStart+contentLength], nil
+}
+
+// skipOversized reports the oversized message to the caller as an empty
+// token while already consuming as much of it as is buffered.
+func (m *messageSplitter) skipOversized(data []byte, atEOF bool) (int, []byte, error) {
+	advance, _, _ := m.discard(data, atEOF)
+	m.oversized = true
+	return advance, []byte{}, nil
+}
+
+func (m *messageSplitter) discard(data []byte, atEOF bool) (int, []byte, error) {
+	if m.discardBytes >= 0 {
+		if len(data) >= m.discardBytes {
+			advance := m.discardBytes
+			m.discarding, m.discardBytes = false, 0
+			return advance, nil, nil
+		}
+		m.discardBytes -= len(data)
+		if atEOF {
+			m.discarding = false
+		}
+		return len(data), nil, nil
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		m.discarding = false
+		return i + 1, nil, nil
+	}
+	if atEOF {
+		m.discarding = false
+	}
+	return len(data), nil, nil
+}
+
+// hasHeaderPrefix reports whether data starts with an LSP style header field.
+func hasHeaderPrefix(data []byte) bool {
+	for _, prefix := range []string{"content-length:", "content-type:"} {
+		if len(data) >= len(prefix) && strings.EqualFold(string(data[:len(prefix)]), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListenAddr splits a -listen value such as tcp://127.0.0.1:9000 or
+// unix:///run/mcp.sock into the network and address that net.Listen expects.
+// A TCP address without a host listens on loopback only.
+func parseListenAddr(value string) (network, addr string, err error) {
+	scheme, rest, ok := strings.Cut(value, "://")
+	if !ok || rest == "" {
+		return "", "", fmt.Errorf("expected scheme://address, e.g. tcp://127.0.0.1:9000")
+	}
+	switch scheme {
+	case "tcp":
+		addr, err := loopbackAddr(rest)
+		if err != nil {
+			return "", "", err
+		}
+		return "tcp", addr, nil
+	case "unix":
+		if !filepath.IsAbs(rest) {
+			return "", "", fmt.Errorf("socket path %q must be absolute", rest)
+		}
+		return "unix", filepath.Clean(rest), nil
+	default:
+		return "", "", fmt.Errorf("unsupported scheme %q", scheme)
+	}
+}
+
+// loopbackAddr fills in 127.0.0.1 when a host:port address leaves out the
+// host. The server has no authentication, so a bare ":8080" must not expose
+// the served files to the network; other interfaces have to be named.
+func loopbackAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// warnIfExposed logs a warning when addr is reachable from other machines.
+func (s *MCPServer) warnIfExposed(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return
+	}
+	access := "read and write"
+	if s.readOnly {
+		access = "read"
+	}
+	slog.Warn("Listening on a non-loopback address without authentication; anyone who can reach it can "+access+" the served files", "addr", addr)
+}
+
+// RunListener serves the protocol over a socket instead of stdio until ctx
+// is cancelled. Connections carry the same stream as stdio and are served
+// one at a time; later clients wait in the accept backlog until the current
+// one disconnects. A positive maxConns stops the listener after that many
+// connections have been served.
+func (s *MCPServer) RunListener(ctx context.Context, network, addr string, maxConns int) error {
+	stop := s.startServices(ctx)
+	defer stop()
+
+	if network == "tcp" {
+		s.warnIfExposed(addr)
+	}
+	listener, err := listenSocket(network, addr)
+	if err != nil {
+		return err
+	}
+	// For unix sockets Close also removes the socket file.
+	defer listener.Close()
+
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down", "reason", context.Cause(ctx))
+		listener.Close()
+	}()
+
+	slog.Info("Server ready, listening for connections", "network", network, "addr", listener.Addr().String())
+	for served := 0; maxConns <= 0 || served < maxConns; served++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.serveConn(ctx, conn)
+	}
+	slog.Info("Served maximum number of connections", "count", maxConns)
+	return nil
+}
+
+// listenSocket opens the listener for RunListener. A unix socket left
+// behind by a server that did not shut down cleanly is replaced, but any
+// other file at the path, or a socket something is still listening on, is
+// refused. The socket is made owner-only, so filesystem permissions decide
+// who may connect.
+func listenSocket(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if info, err := os.Lstat(addr); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", addr)
+		}
+		if conn, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", addr)
+		}
+		slog.Info("Removing stale socket", "path", addr)
+		if err := os.Remove(addr); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveConn serves one client connection and then forgets the client, so
+// that the next connection starts from a clean session.
+func (s *MCPServer) serveConn(ctx context.Context, conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	slog.Info("Client connected", "remote", remote)
+
+	// Closing the connection is what unblocks a pending read on shutdown.
+	connCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	err := s.serveStream(connCtx, conn, conn)
+	cancel()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Warn("Connection ended with error", "remote", remote, "error", err)
+	}
+
+	s.writeMu.Lock()
+	s.out = bufio.NewWriter(io.Discard)
+	s.writeMu.Unlock()
+
+	s.subsMu.Lock()
+	clear(s.subscriptions)
+	s.subsMu.Unlock()
+	s.clientLogEnabled.Store(false)
+
+	slog.Info("Client disconnected", "remote", remote)
+}
+
+// httpEndpoint is the path of the Streamable HTTP endpoint: POST carries
+// JSON-RPC requests, GET opens an event stream for notifications.
+const httpEndpoint = "/mcp"
+
+// RunHTTP serves the protocol over HTTP instead of stdio until ctx is
+// cancelled. Requests go through the same handleMessage dispatch, one at a
+// time. An address without a host listens on loopback only.
+func (s *MCPServer) RunHTTP(ctx context.Context, addr string) error {
+	addr, err := loopbackAddr(addr)
+	if err != nil {
+		return err
+	}
+	s.warnIfExposed(addr)
+	s.httpMode = true
+
+	stop := s.startServices(ctx)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpEndpoint, s.handleHTTP)
+
+	// Event streams end with their request context, so Shutdown does not
+	// wait on them forever.
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down", "reason", context.Cause(ctx))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Server ready, listening for HTTP", "addr", addr, "endpoint", httpEndpoint)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *MCPServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers attach an Origin; only local pages may talk to the server,
+	// which guards against DNS rebinding.
+	if origin := r.Header.Get("Origin"); origin != "" && !isLocalOrigin(origin) {
+		http.Error(w, "Forbidden origin", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.handleHTTPPost(w, r)
+	case http.MethodGet:
+		s.handleHTTPEvents(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *MCPServer) handleHTTPPost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxMessageSize)))
+	if err != nil {
+		slog.Warn("Discarded oversized message", "limit", s.maxMessageSize)
+		s.writeHTTPReplies(w, http.StatusRequestEntityTooLarge, s.collectReplies(nil, false, func() error {
+			return s.sendError(nil, -32600, fmt.Sprintf("Invalid Request: message exceeds maximum size of %d bytes", s.maxMessageSize))
+		}))
+		return
+	}
+
+	slog.Debug("Received message", "message", string(body))
+
+	var msg JSONRPCMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		slog.Error("Invalid JSON", "error", err)
+		s.writeHTTPReplies(w, http.StatusBadRequest, s.collectReplies(nil, false, func() error {
+			return s.sendError(nil, -32700, "Parse error")
+		}))
+		return
+	}
+
+	// Cancellations must not wait behind the request they cancel.
+	if msg.Method == "notifications/cancelled" {
+		s.handleCancelled(msg.Params)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	reqCtx, done := s.beginRequest(r.Context(), msg.ID)
+	defer done()
+
+	replies := s.collectReplies(msg.ID, isDetachedRequest(msg), func() error {
+		return s.handleMessage(reqCtx, msg)
+	})
+	s.writeHTTPReplies(w, http.StatusOK, replies)
+}
+
+// collectReplies runs dispatch with the responses to id captured instead of
+// sent. Requests run one at a time under dispatchMu, as they do on stdio,
+// except detached ones, which may block for a long time.
+func (s *MCPServer) collectReplies(id interface{}, detached bool, dispatch func() error) [][]byte {
+	if !detached {
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+	}
+
+	key := requestKey(id)
+	var replies [][]byte
+	s.writeMu.Lock()
+	s.replies[key] = &replies
+	s.writeMu.Unlock()
+
+	if err := dispatch(); err != nil {
+		slog.Error("Error handling message", "error", err)
+	}
+
+	s.writeMu.Lock()
+	delete(s.replies, key)
+	s.writeMu.Unlock()
+
+	return replies
+}
+
+// writeHTTPReplies answers a POST with its JSON-RPC response, or 202 Accepted
+// when the message was a notification and produced none.
+func (s *MCPServer) writeHTTPReplies(w http.ResponseWriter, status int, replies [][]byte) {
+	if len(replies) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(replies[0])
+}
+
+func (s *MCPServer) handleHTTPEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan []byte, 64)
+	s.sseMu.Lock()
+	s.sseClients[events] = struct{}{}
+	s.sseMu.Unlock()
+
+	defer func() {
+		s.sseMu.Lock()
+		delete(s.sseClients, events)
+		s.sseMu.Unlock()
+	}()
+
+	slog.Debug("Event stream opened", "remote", r.RemoteAddr)
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Debug("Event stream closed", "remote", r.RemoteAddr)
+			return
+		case data := <-events:
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// broadcastEvent queues a notification on every open event stream. A stream
+// that has fallen too far behind misses the event rather than blocking the
+// server.
+func (s *MCPServer) broadcastEvent(data []byte) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+
+	for events := range s.sseClients {
+		select {
+		case events <- data:
+		default:
+		}
+	}
+}
+
+// isLocalOrigin reports whether an Origin header names the local machine.
+func isLocalOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// subscriptionDebounce coalesces bursts of filesystem events, such as an
+// editor's write-and-rename, into a single notification.
+const subscriptionDebounce = 100 * time.Millisecond
+
+// startWatcher watches every directory under the served roots so that
+// subscribed files produce notifications/resources/updated and added or
+// removed files produce notifications/resources/list_changed.
+func (s *MCPServer) startWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	for _, root := range s.roots {
+		err = filepath.WalkDir(root.Dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if p != root.Dir && isVCSDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			if err := watcher.Add(p); err != nil {
+				slog.Warn("Cannot watch directory", "path", p, "error", err)
+			}
+			return nil
+		})
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	s.subsMu.Lock()
+	s.watcher = watcher
+	s.subsMu.Unlock()
+
+	go s.watchLoop(watcher)
+	return nil
+}
+
+// stopWatcher closes the watcher and drops any pending notifications.
+func (s *MCPServer) stopWatcher() {
+	s.subsMu.Lock()
+	watcher := s.watcher
+	s.watcher = nil
+	for path, timer := range s.pendingUpdates {
+		timer.Stop()
+		delete(s.pendingUpdates, path)
+	}
+	if s.listChangedTimer != nil {
+		s.listChangedTimer.Stop()
+		s.listChangedTimer = nil
+	}
+	s.subsMu.Unlock()
+
+	if watcher != nil {
+		watcher.Close()
+	}
+}
+
+func (s *MCPServer) watchLoop(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			s.handleWatchEvent(watcher, event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("File watcher error", "error", err)
+		}
+	}
+}
+
+func (s *MCPServer) handleWatchEvent(watcher *fsnotify.Watcher, event fsnotify.Event) {
+	if s.isReservedPath(event.Name) {
+		return
+	}
+
+	if event.Has(fsnotify.Create) {
+		// New directories need their own watch to see files created in them.
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() && !isVCSDir(filepath.Base(event.Name)) {
+			if err := watcher.Add(event.Name); err != nil {
+				slog.Warn("Cannot watch directory", "path", event.Name, "error", err)
+			}
+		}
+	}
+
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		s.scheduleListChanged()
+	}
+
+	s.subsMu.Lock()
+	sub, subscribed := s.subscriptions[event.Name]
+	s.subsMu.Unlock()
+	if subscribed {
+		s.scheduleResourceUpdated(event.Name, sub)
+	}
+}
+
+func (s *MCPServer) scheduleResourceUpdated(path string, sub *subscription) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	if timer, ok := s.pendingUpdates[path]; ok {
+		timer.Reset(subscriptionDebounce)
+		return
+	}
+
+	s.pendingUpdates[path] = time.AfterFunc(subscriptionDebounce, func() {
+		s.subsMu.Lock()
+		delete(s.pendingUpdates, path)
+		stillSubscribed := s.subscriptions[path] == sub
+		s.subsMu.Unlock()
+
+		switch {
+		case !stillSubscribed:
+		case sub.tail:
+			s.sendTailUpdate(path, sub)
+		default:
+			s.sendNotification("notifications/resources/updated", map[string]interface{}{"uri": sub.uri})
+		}
+	})
+}
+
+// subscription is one resources/subscribe. A tail subscription remembers
+// how far into the file it has sent, and which file that was, so rotation
+// can be told apart from appends.
+type subscription struct {
+	uri  string
+	tail bool
+
+	mu     sync.Mutex
+	offset int64
+	file   fs.FileInfo
+}
+
+// sendTailUpdate sends what was appended to a tail-subscribed file since the
+// last update, in the notification's meta as text (or a base64 blob) with
+// its offset. A file that shrank or was replaced is sent again from its
+// start, marked with reset.
+func (s *MCPServer) sendTailUpdate(path string, sub *subscription) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	params := map[string]interface{}{"uri": sub.uri}
+
+	info, err := s.files.Stat(path)
+	if err != nil || info.IsDir() {
+		// Deleted or rotated away; whatever appears here next is new.
+		sub.offset, sub.file = 0, nil
+		s.sendNotification("notifications/resources/updated", params)
+		return
+	}
+
+	reset := info.Size() < sub.offset || (sub.file != nil && !os.SameFile(sub.file, info))
+	if reset {
+		sub.offset = 0
+	}
+	sub.file = info
+	if info.Size() == sub.offset && !reset {
+		return
+	}
+
+	content, start, end, _, err := readByteRange(s.files, path, sub.offset, s.maxFileSize)
+	if err != nil {
+		slog.Warn("Cannot read appended content", "path", path, "error", err)
+		return
+	}
+	sub.offset = end
+	s.recordAudit("resources/subscribe", s.relativePath(path), sub.uri, len(content))
+
+	meta := map[string]interface{}{"offset": start}
+	if reset {
+		meta["reset"] = true
+	}
+	if isBinaryContent(content) {
+		meta["blob"] = base64.StdEncoding.EncodeToString(content)
+	} else {
+		meta["text"] = string(content)
+	}
+	params["meta"] = meta
+	s.sendNotification("notifications/resources/updated", params)
+}
+
+func (s *MCPServer) scheduleListChanged() {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	if s.listChangedTimer != nil {
+		s.listChangedTimer.Reset(subscriptionDebounce)
+		return
+	}
+
+	s.listChangedTimer = time.AfterFunc(subscriptionDebounce, func() {
+		s.subsMu.Lock()
+		s.listChangedTimer = nil
+		s.subsMu.Unlock()
+
+		s.sendNotification("notifications/resources/list_changed", nil)
+	})
+}
+
+// checkBaseDir reports whether every served root exists, recreating missing
+// ones first when createDir is set.
+func (s *MCPServer) checkBaseDir() bool {
+	available := true
+	for _, root := range s.roots {
+		if !s.checkRootDir(root.Dir) {
+			available = false
+		}
+	}
+	return available
+}
+
+func (s *MCPServer) checkRootDir(dir string) bool {
+	info, err := os.Stat(dir)
+	if err == nil {
+		return info.IsDir()
+	}
+
+	if s.createDir && os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			slog.Error("Failed to recreate served directory", "dir", dir, "error", err)
+			return false
+		}
+		slog.Info("Recreated served directory", "dir", dir)
+		return true
+	}
+
+	return false
+}
+
+func (s *MCPServer) watchBaseDir(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		available := s.checkBaseDir()
+		if s.baseDirAvailable.Swap(available) != available {
+			if available {
+				slog.Info("Served directory is available again", "dirs", s.rootDirList())
+			} else {
+				slog.Error("Served directory is unavailable", "dirs", s.rootDirList())
+			}
+		}
+	}
+}
+
+// Utility Functions
+
+const utf8BOM = "\ufeff"
+
+// resolvePath joins a client-supplied path onto the root it names and
+// verifies that the result does not escape that root, either lexically or by
+// following symlinks.
+func (s *MCPServer) resolvePath(path string) (string, error) {
+	absPath, err := s.resolveLinkPath(path)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkRealPath(absPath); err != nil {
+		return "", err
+	}
+	return absPath, nil
+}
+
+// resolveLinkPath is resolvePath without following a final symlink, for
+// tools that act on a link itself (delete, move, stat). Callers must still
+// check the parent with checkRealParent.
+func (s *MCPServer) resolveLinkPath(path string) (string, error) {
+	if err := checkPathChars(path); err != nil {
+		return "", err
+	}
+	path, err := cleanClientPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	root, rest := s.splitRoot(path)
+	absPath, err := filepath.Abs(filepath.Join(root.Dir, rest))
+	if err != nil {
+		return "", fmt.Errorf("Invalid file path")
+	}
+
+	if !isWithinDir(root.Dir, absPath) {
+		return "", fmt.Errorf("Access denied: path outside allowed directory")
+	}
+
+	if s.isReservedPath(absPath) {
+		return "", fmt.Errorf("Access denied: path is reserved by the server")
+	}
+
+	if len(s.includeGlobs) > 0 || len(s.excludeGlobs) > 0 {
+		info, err := s.files.Stat(absPath)
+		if s.isFilteredOut(absPath, err == nil && info.IsDir()) {
+			return "", fmt.Errorf("Access denied: path is excluded by server filters")
+		}
+	}
+
+	return absPath, nil
+}
+
+// cleanClientPath normalizes a client path before it is joined onto a root.
+// Client paths are always relative to the roots, so leading separators are
+// dropped ("/docs/a.md" is docs/a.md) and a drive letter or volume name, which
+// cannot be made relative, is rejected on every OS alike. A ".." that climbs
+// out of the root survives cleaning and is refused by the containment check.
+func cleanClientPath(path string) (string, error) {
+	if len(path) >= 2 && path[1] == ':' && ('a' <= path[0]|0x20 && path[0]|0x20 <= 'z') {
+		return "", fmt.Errorf("Invalid path: %q has a drive letter; paths are relative to the served directory", path)
+	}
+	if filepath.VolumeName(path) != "" {
+		return "", fmt.Errorf("Invalid path: %q has a volume name; paths are relative to the served directory", path)
+	}
+
+	path = strings.TrimLeft(path, "/"+string(filepath.Separator))
+	return filepath.Clean(path), nil
+}
+
+// checkPathChars rejects paths containing NUL or other control characters,
+// which no legitimate file name needs and which the OS may truncate at or
+// otherwise treat surprisingly.
+func checkPathChars(path string) error {
+	for _, r := range path {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("Invalid path: contains control character %U", r)
+		}
+	}
+	return nil
+}
+
+// isFilteredOut reports whether -include/-exclude hide a path. Excludes win
+// over includes, and an excluded directory hides everything below it.
+// Includes never filter directories, so included files inside them stay
+// reachable.
+func (s *MCPServer) isFilteredOut(absPath string, isDir bool) bool {
+	relPath := absPath
+	if root, ok := s.rootFor(absPath); ok {
+		relPath, _ = filepath.Rel(root.Dir, absPath)
+	}
+	relPath = filepath.ToSlash(relPath)
+	if relPath == "." {
+		return false
+	}
+
+	if matchesAnyGlob(s.excludeGlobs, relPath) {
+		return true
+	}
+	return !isDir && len(s.includeGlobs) > 0 && !matchesAnyGlob(s.includeGlobs, relPath)
+}
+
+// matchesAnyGlob reports whether any glob matches the slash-separated
+// relative path or one of the directories above it.
+func matchesAnyGlob(globs []*regexp.Regexp, relPath string) bool {
+	for p := relPath; p != "." && p != "/"; p = path.Dir(p) {
+		for _, glob := range globs {
+			if glob.MatchString(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseGlobList splits and compiles a comma-separated -include/-exclude
+// value, rejecting malformed patterns up front.
+func parseGlobList(value string) ([]*regexp.Regexp, error) {
+	var globs []*regexp.Regexp
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		matcher, err := compilePathGlob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+		globs = append(globs, matcher)
+	}
+	return globs, nil
+}
+
+// compilePathGlob compiles a glob given by a client or operator for matching
+// slash-separated paths relative to a root: one without a slash matches a
+// name at any depth, one with a slash matches the path from the root, and
+// "**" spans directories. A trailing slash is dropped, so "secrets/" names
+// the directory.
+func compilePathGlob(glob string) (*regexp.Regexp, error) {
+	glob = strings.TrimSuffix(filepath.ToSlash(glob), "/")
+	return globToRegexp(strings.TrimPrefix(glob, "/"), strings.Contains(glob, "/"))
+}
+
+// matchesPathGlob reports whether a glob from compilePathGlob matches a file,
+// by its path relative to its root or, with several roots, by the
+// root-prefixed name tools report.
+func (s *MCPServer) matchesPathGlob(glob *regexp.Regexp, absPath string) bool {
+	if root, ok := s.rootFor(absPath); ok {
+		if rel, err := filepath.Rel(root.Dir, absPath); err == nil && glob.MatchString(filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return glob.MatchString(filepath.ToSlash(s.relativePath(absPath)))
+}
+
+// splitRoot picks the root a client path refers to. With several roots a
+// path may start with a root's name; any other path is relative to the first
+// root, exactly as when only one root is served.
+func (s *MCPServer) splitRoot(path string) (Root, string) {
+	if len(s.roots) > 1 {
+		clean := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+		first, rest, _ := strings.Cut(clean, "/")
+		for _, root := range s.roots {
+			if root.Name == first {
+				return root, rest
+			}
+		}
+	}
+	return s.roots[0], path
+}
+
+// rootDirList joins the root directories for log and error messages.
+func (s *MCPServer) rootDirList() string {
+	dirs := make([]string, len(s.roots))
+	for i, root := range s.roots {
+		dirs[i] = root.Dir
+	}
+	return strings.Join(dirs, ", ")
+}
+
+// rootFor returns the root that contains absPath. Nested roots resolve to
+// the innermost one.
+func (s *MCPServer) rootFor(absPath string) (Root, bool) {
+	var found Root
+	ok := false
+	for _, root := range s.roots {
+		if isWithinDir(root.Dir, absPath) && (!ok || len(root.Dir) > len(found.Dir)) {
+			found, ok = root, true
+		}
+	}
+	return found, ok
+}
+
+// withinRoots reports whether absPath lies under any served root.
+func (s *MCPServer) withinRoots(absPath string) bool {
+	_, ok := s.rootFor(absPath)
+	return ok
+}
+
+// isRootDir reports whether absPath is one of the served roots itself.
+func (s *MCPServer) isRootDir(absPath string) bool {
+	root, ok := s.rootFor(absPath)
+	return ok && root.Dir == absPath
+}
+
+// realRelativePath is relativePath for symlink-resolved paths: each root is
+// compared with its own symlinks resolved. It reports false for paths that
+// resolve outside every root.
+func (s *MCPServer) realRelativePath(resolved string) (string, bool) {
+	for _, root := range s.roots {
+		realDir, err := s.files.EvalSymlinks(root.Dir)
+		if err != nil || !isWithinDir(realDir, resolved) {
+			continue
+		}
+		relPath, err := filepath.Rel(realDir, resolved)
+		if err != nil {
+			continue
+		}
+		if len(s.roots) > 1 {
+			relPath = filepath.Join(root.Name, relPath)
+		}
+		return relPath, true
+	}
+	return "", false
+}
+
+// checkRealPath rejects paths that resolve through symlinks to somewhere
+// outside the served roots, including dangling links whose target would be
+// created outside them. With -no-follow-symlinks any symlink below a root is
+// refused.
+func (s *MCPServer) checkRealPath(absPath string) error {
+	resolved, err := evalSymlinksPartial(s.files, absPath)
+	if err != nil {
+		return fmt.Errorf("Access denied: cannot resolve symlinks: %v", err)
+	}
+
+	if s.noFollowSymlinks {
+		if root, ok := s.rootFor(absPath); ok {
+			realRoot, err := s.files.EvalSymlinks(root.Dir)
+			relPath, _ := filepath.Rel(root.Dir, absPath)
+			if err == nil && resolved != filepath.Join(realRoot, relPath) {
+				return fmt.Errorf("Access denied: symlinks are not followed")
+			}
+		}
+		if info, err := s.files.Lstat(absPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Access denied: symlinks are not followed")
+		}
+	}
+
+	// evalSymlinksPartial stops at a dangling link, so chase its target by
+	// hand; a write through it would create the target.
+	for hops := 0; ; hops++ {
+		info, err := s.files.Lstat(resolved)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		if hops == 255 {
+			return fmt.Errorf("Access denied: too many levels of symlinks")
+		}
+		target, err := s.files.Readlink(resolved)
+		if err != nil {
+			return fmt.Errorf("Access denied: cannot resolve symlinks: %v", err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(resolved), target)
+		}
+		if resolved, err = evalSymlinksPartial(s.files, target); err != nil {
+			return fmt.Errorf("Access denied: cannot resolve symlinks: %v", err)
+		}
+	}
+
+	if _, ok := s.realRelativePath(resolved); !ok {
+		return fmt.Errorf("Access denied: path resolves outside allowed directory")
+	}
+	return nil
+}
+
+// walkDir is FileService.WalkDir for tools that scan a tree on behalf of a
+// client. Reserved and filtered-out files are left out, as they are for
+// tools given a path directly, and an excluded directory is skipped whole.
+//
+// With -follow-symlinks it also descends into symlinked directories,
+// reporting their contents under the link's own path. Links are followed
+// after the ordinary walk and only into directories it has not visited yet,
+// so each directory is walked once, under its real path when the walk
+// reaches that too; this also breaks cycles. Links that checkRealPath
+// refuses are passed to fn unfollowed.
+func (s *MCPServer) walkDir(root string, fn fs.WalkDirFunc) error {
+	type dirLink struct{ path, target string }
+	var links []dirLink
+	visited := make(map[string]bool)
+	stopped := false
+
+	walk := func(dir, as string) error {
+		return s.files.WalkDir(dir, func(path string, d fs.DirEntry, walkErr error) error {
+			if as != dir {
+				rel, _ := filepath.Rel(dir, path)
+				path = filepath.Join(as, rel)
+				if rel == "." {
+					if info, err := s.files.Stat(as); err == nil {
+						d = fs.FileInfoToDirEntry(info)
+					}
+				}
+			}
+
+			if walkErr == nil && !d.IsDir() && (s.isReservedPath(path) || s.isFilteredOut(path, false)) {
+				return nil
+			}
+			if walkErr == nil && d.IsDir() && path != root && s.isFilteredOut(path, true) {
+				return filepath.SkipDir
+			}
+
+			if s.followSymlinks && walkErr == nil && d.Type()&fs.ModeSymlink != 0 {
+				if target, ok := s.symlinkedDir(path); ok {
+					links = append(links, dirLink{path, target})
+					return nil
+				}
+			}
+
+			if err := fn(path, d, walkErr); err != nil {
+				stopped = err == filepath.SkipAll
+				return err
+			}
+			if s.followSymlinks && walkErr == nil && d.IsDir() {
+				if real, err := s.files.EvalSymlinks(path); err == nil {
+					visited[real] = true
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := walk(root, root); err != nil {
+		return err
+	}
+	for len(links) > 0 && !stopped {
+		link := links[0]
+		links = links[1:]
+		if visited[link.target] {
+			continue
+		}
+		if err := walk(link.target, link.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symlinkedDir reports whether path is a symlink to a directory that may be
+// followed, and returns the directory's real path.
+func (s *MCPServer) symlinkedDir(path string) (string, bool) {
+	target, err := s.files.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	if info, err := s.files.Stat(target); err != nil || !info.IsDir() {
+		return "", false
+	}
+	if err := s.checkRealPath(path); err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+// checkRealParent rejects paths whose parent directory resolves through
+// symlinks to somewhere outside the served roots. The final element is not
+// followed, so a symlink itself can still be moved or deleted.
+func (s *MCPServer) checkRealParent(absPath string) error {
+	if realParent, err := s.files.EvalSymlinks(filepath.Dir(absPath)); err == nil {
+		if _, ok := s.realRelativePath(realParent); !ok {
+			return fmt.Errorf("Access denied: path outside allowed directory")
+		}
+	}
+	return nil
+}
+
+// isReservedPath reports whether path is a file the server itself owns, such
+// as the audit log, which is hidden from listings and refused to clients.
+func (s *MCPServer) isReservedPath(path string) bool {
+	if s.auditLogPath == "" {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	return err == nil && absPath == s.auditLogPath
+}
+
+// hiddenEntry reports whether anything under dir is hidden from clients,
+// being reserved or filtered out. Directories are never filtered themselves,
+// so copying or moving one would otherwise bring such files out under a new
+// name.
+func (s *MCPServer) hiddenEntry(ctx context.Context, dir string) (bool, error) {
+	if s.auditLogPath == "" && len(s.includeGlobs) == 0 && len(s.excludeGlobs) == 0 {
+		return false, nil
+	}
+
+	hidden := false
+	err := s.files.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if s.isReservedPath(path) || s.isFilteredOut(path, d.IsDir()) {
+			hidden = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return hidden, err
+}
+
+// entryAllowed reports whether an entry found inside an already resolved
+// directory may be shown or read. Reserved and filtered-out paths are
+// hidden, and a symlink must pass checkRealPath, just as when a tool is given
+// its path directly.
+func (s *MCPServer) entryAllowed(path string, d fs.DirEntry) bool {
+	if s.isReservedPath(path) || s.isFilteredOut(path, d.IsDir()) {
+		return false
+	}
+	if d.Type()&fs.ModeSymlink != 0 {
+		return s.checkRealPath(path) == nil
+	}
+	return true
+}
+
+// relativePath converts an absolute path produced by resolvePath back into
+// the form clients use: relative to its root, and prefixed with the root name
+// when several roots are served.
+func (s *MCPServer) relativePath(absPath string) string {
+	root, ok := s.rootFor(absPath)
+	if !ok {
+		return absPath
+	}
+
+	relPath, err := filepath.Rel(root.Dir, absPath)
+	if err != nil {
+		return absPath
+	}
+	if len(s.roots) > 1 {
+		return filepath.Join(root.Name, relPath)
+	}
+	return relPath
+}
+
+// isWithinDir reports whether path is dir itself or lies underneath it.
+// Both arguments must be absolute and cleaned.
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isBinaryContent uses the same heuristic as most tools: a NUL byte in the
+// first few kilobytes, or content that is not valid UTF-8, means binary.
+func isBinaryContent(data []byte) bool {
+	sample := data
+	if len(sample) > 8000 {
+		sample = sample[:8000]
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	return !utf8.Valid(data)
+}
+
+func getStringArg(args map[string]interface{}, name string) (string, error) {
+	arg, ok := args[name]
+	if !ok {
+		return "", fmt.Errorf("Missing required argument: %s", name)
+	}
+
+	value, ok := arg.(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid %s argument: must be string", name)
+	}
+	return value, nil
+}
+
+func getOptionalStringArg(args map[string]interface{}, name string, def string) (string, error) {
+	arg, ok := args[name]
+	if !ok {
+		return def, nil
+	}
+
+	value, ok := arg.(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid %s argument: must be string", name)
+	}
+	return value, nil
+}
+
+func getStringArrayArg(args map[string]interface{}, name string) ([]string, error) {
+	arg, ok := args[name]
+	if !ok {
+		return nil, fmt.Errorf("Missing required argument: %s", name)
+	}
+
+	items, ok := arg.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s argument: must be array of strings", name)
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		value, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid %s argument: must be array of strings", name)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func getIntArg(args map[string]interface{}, name string) (int, error) {
+	arg, ok := args[name]
+	if !ok {
+		return 0, fmt.Errorf("Missing required argument: %s", name)
+	}
+
+	value, ok := arg.(float64)
+	if !ok || value != math.Trunc(value) {
+		return 0, fmt.Errorf("Invalid %s argument: must be integer", name)
+	}
+	return int(value), nil
+}
+
+func getOptionalIntArg(args map[string]interface{}, name string, def int) (int, error) {
+	if _, ok := args[name]; !ok {
+		return def, nil
+	}
+	return getIntArg(args, name)
+}
+
+func getOptionalNumberArg(args map[string]interface{}, name string, def float64) (float64, error) {
+	arg, ok := args[name]
+	if !ok {
+		return def, nil
+	}
+
+	value, ok := arg.(float64)
+	if !ok {
+		return 0, fmt.Errorf("Invalid %s argument: must be number", name)
+	}
+	return value, nil
+}
+
+func getOptionalBoolArg(args map[string]interface{}, name string, def bool) (bool, error) {
+	arg, ok := args[name]
+	if !ok {
+		return def, nil
+	}
+
+	value, ok := arg.(bool)
+	if !ok {
+		return false, fmt.Errorf("Invalid %s argument: must be boolean", name)
+	}
+	return value, nil
+}
+
+// defaultMaxResults bounds the number of paths returned by search-style tools.
+const defaultMaxResults = 1000
+
+// errSearchTruncated stops a search_files walk once max_results is exceeded.
+var errSearchTruncated = errors.New("search truncated")
+
+// defaultMaxDepth limits how deep tree-style tools descend unless told otherwise.
+const defaultMaxDepth = 10
+
+// maxTreeNodes bounds the number of nodes returned by tree_json.
+const maxTreeNodes = 5000
+
+// previewBytes is how much of each file directory_previews shows, and
+// maxPreviewTotalBytes bounds the combined size of all previews.
+const (
+	previewBytes         = 200
+	maxPreviewTotalBytes = 64 << 10
+)
+
+// defaultToolsPageSize is how many tools a tools/list page holds.
+const defaultToolsPageSize = 50
+
+// maxReadFiles caps how many files one read_files call may ask for.
+const maxReadFiles = 50
+
+// maxWaitSeconds caps how long a blocking tool such as wait_for_stable may run.
+const maxWaitSeconds = 300
+
+// maxMarkdownEntries bounds the size of list_as_markdown output for huge trees.
+const maxMarkdownEntries = 1000
+
+// writeMarkdownTree appends the entries of dir as markdown bullets indented
+// by depth, leaving out reserved and filtered-out files as list_directory
+// does. It reports whether the output was cut short by maxMarkdownEntries.
+func (s *MCPServer) writeMarkdownTree(w *strings.Builder, dir string, depth int, recursive bool, count *int) (bool, error) {
+	entries, err := s.files.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	indent := strings.Repeat("  ", depth)
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+		if s.isReservedPath(entryPath) || s.isFilteredOut(entryPath, entry.IsDir()) {
+			continue
+		}
+		if *count >= maxMarkdownEntries {
+			return true, nil
+		}
+		*count++
+
+		if entry.IsDir() {
+			w.WriteString(fmt.Sprintf("%s- **%s/**\n", indent, entry.Name()))
+			if recursive {
+				truncated, err := s.writeMarkdownTree(w, entryPath, depth+1, recursive, count)
+				if err != nil {
+					w.WriteString(fmt.Sprintf("%s  - _(unreadable: %v)_\n", indent, err))
+				}
+				if truncated {
+					return true, nil
+				}
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err == nil {
+			w.WriteString(fmt.Sprintf("%s- %s (%d bytes)\n", indent, entry.Name(), info.Size()))
+		} else {
+			w.WriteString(fmt.Sprintf("%s- %s\n", indent, entry.Name()))
+		}
+	}
+
+	return false, nil
+}
+
+// isSafeZipEntryName rejects entry names that would escape an extraction
+// directory (zip-slip): absolute paths, drive letters and ".." segments.
+func isSafeZipEntryName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || strings.Contains(name, ":") {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// markdownHeading returns the level and title of an ATX heading line, or a
+// level of 0 when the line is not a heading.
+func markdownHeading(line string) (int, string) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0, ""
+	}
+
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0, ""
+	}
+
+	rest := trimmed[level:]
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return 0, ""
+	}
+
+	title := strings.TrimSpace(rest)
+	title = strings.TrimSpace(strings.TrimRight(title, "#"))
+	return level, title
+}
+
+// forEachMarkdownLine calls fn for every line with its heading level, treating
+// lines inside fenced code blocks as plain text.
+func forEachMarkdownLine(lines []string, fn func(i, level int, title string)) {
+	inFence := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			fn(i, 0, "")
+			continue
+		}
+		if inFence {
+			fn(i, 0, "")
+			continue
+		}
+		level, title := markdownHeading(line)
+		fn(i, level, title)
+	}
+}
+
+// parseMarkdownSections splits lines into one section per heading. Text before
+// the first heading becomes a level 0 section with an empty heading.
+func parseMarkdownSections(lines []string) []MarkdownSection {
+	sections := []MarkdownSection{}
+	current := MarkdownSection{}
+	var body []string
+
+	flush := func() {
+		current.Content = strings.Trim(strings.Join(body, "\n"), "\n")
+		if current.Level > 0 || current.Content != "" {
+			sections = append(sections, current)
+		}
+	}
+
+	forEachMarkdownLine(lines, func(i, level int, title string) {
+		if level == 0 {
+			body = append(body, lines[i])
+			return
+		}
+		flush()
+		current = MarkdownSection{Heading: title, Level: level}
+		body = nil
+	})
+	flush()
+
+	return sections
+}
+
+// markdownSectionContent returns the named section including any nested
+// subsections, up to the next heading of the same or a higher level.
+func markdownSectionContent(lines []string, name string) (string, bool) {
+	start, end, level := -1, len(lines), 0
+
+	forEachMarkdownLine(lines, func(i, l int, title string) {
+		if l == 0 {
+			return
+		}
+		if start < 0 {
+			if strings.EqualFold(title, strings.TrimSpace(name)) {
+				start, level = i, l
+			}
+			return
+		}
+		if end == len(lines) && l <= level {
+			end = i
+		}
+	})
+
+	if start < 0 {
+		return "", false
+	}
+	return strings.Trim(strings.Join(lines[start:end], "\n"), "\n"), true
+}
+
+// FileService is the filesystem the tools read and write, and that
+// resolvePath checks symlinks against. Names are absolute paths below the
+// served roots; the audit log, the config file and the watchers always use
+// the host filesystem.
+type FileService interface {
+	Open(name string) (File, error)
+	ReadFile(name string) ([]byte, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+	EvalSymlinks(name string) (string, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	WalkDir(root string, fn fs.WalkDirFunc) error
+	// WriteFile replaces name atomically with what write produces.
+	WriteFile(name string, perm fs.FileMode, write func(io.Writer) error) error
+	AppendFile(name string, data []byte, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Symlink(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+}
+
+// File is an open file from a FileService. Range and tail reads seek, and
+// zip archives are read in place.
+type File interface {
+	fs.File
+	io.Seeker
+	io.ReaderAt
+}
+
+// osFileService is the FileService the server runs with.
+type osFileService struct{}
+
+func (osFileService) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileService) ReadFile(name string) ([]byte, error)         { return os.ReadFile(name) }
+func (osFileService) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (osFileService) Lstat(name string) (fs.FileInfo, error)       { return os.Lstat(name) }
+func (osFileService) Readlink(name string) (string, error)         { return os.Readlink(name) }
+func (osFileService) EvalSymlinks(name string) (string, error)     { return filepath.EvalSymlinks(name) }
+func (osFileService) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (osFileService) WalkDir(root string, fn fs.WalkDirFunc) error { return filepath.WalkDir(root, fn) }
+func (osFileService) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFileService) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (osFileService) Remove(name string) error                     { return os.Remove(name) }
+func (osFileService) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFileService) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+
+func (osFileService) WriteFile(name string, perm fs.FileMode, write func(io.Writer) error) error {
+	return writeAtomic(name, perm, write)
+}
+
+func (osFileService) AppendFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readFileLimited reads a whole file, refusing files larger than the
+// configured maximum so a single read cannot exhaust memory.
+func (s *MCPServer) readFileLimited(absPath string) ([]byte, error) {
+	info, err := s.files.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() > s.maxFileSize {
+		return nil, &FileTooLargeError{Size: info.Size(), Limit: s.maxFileSize}
+	}
+
+	return s.files.ReadFile(absPath)
+}
+
+// errDecompressedTooLarge is returned by readGzipFile when the content
+// inflates past the size limit.
+var errDecompressedTooLarge = errors.New("decompressed content too large")
+
+// invalidGzipError is returned by readGzipFile when the file could be read
+// but is not valid gzip.
+type invalidGzipError struct {
+	err error
+}
+
+func (e *invalidGzipError) Error() string {
+	return e.err.Error()
+}
+
+// readGzipFile decompresses a .gz file for read_file. The header can not be
+// trusted about the size, so the limit is enforced on what is inflated.
+func readGzipFile(files FileService, absPath string, limit int64) ([]byte, error) {
+	f, err := files.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Errors from the file itself are *fs.PathError; anything else comes
+	// from the gzip data.
+	wrap := func(err error) error {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		return &invalidGzipError{err}
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	defer zr.Close()
+
+	content, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if int64(len(content)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return content, nil
+}
+
+// FileTooLargeError is returned by readFileLimited for files over the
+// -max-file-size limit.
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file size %d bytes exceeds limit of %d bytes", e.Size, e.Limit)
+}
+
+// evalSymlinksPartial resolves symlinks in the longest existing prefix of
+// absPath and appends the remaining, not yet existing, components unchanged.
+func evalSymlinksPartial(files FileService, absPath string) (string, error) {
+	existing := absPath
+	var missing []string
+
+	for {
+		resolved, err := files.EvalSymlinks(existing)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return absPath, nil
+		}
+		missing = append(missing, filepath.Base(existing))
+		existing = parent
+	}
+}
+
+// hashFileSHA256 streams a file through SHA-256 and returns the hex digest.
+func hashFileSHA256(files FileService, path string) (string, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+type fileLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// lockFile locks absPath against other writes through this server and
+// returns the function that unlocks it. Writes by other processes are not
+// covered. A lock is dropped when nobody holds or waits for it.
+func (s *MCPServer) lockFile(absPath string) func() {
+	s.fileLocksMu.Lock()
+	if s.fileLocks == nil {
+		s.fileLocks = make(map[string]*fileLock)
+	}
+	lock := s.fileLocks[absPath]
+	if lock == nil {
+		lock = &fileLock{}
+		s.fileLocks[absPath] = lock
+	}
+	lock.users++
+	s.fileLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		s.fileLocksMu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(s.fileLocks, absPath)
+		}
+		s.fileLocksMu.Unlock()
+	}
+}
+
+// writeFileAtomic replaces path with data through files.WriteFile, so
+// readers never observe a partially written file. An existing file keeps its
+// permission bits; new files get perm.
+func writeFileAtomic(files FileService, path string, data []byte, perm os.FileMode) error {
+	if info, err := files.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return files.WriteFile(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic is the atomic write behind osFileService.WriteFile: write
+// fills a temporary file in path's directory, which is fsynced, given perm
+// and renamed over path. On failure path is left untouched.
+func writeAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := replaceFile(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// replaceFile renames src over dst. Windows refuses the rename while another
+// process (often a virus scanner or indexer) briefly has dst open, so there
+// it retries for a short while. Elsewhere the directory is fsynced so the
+// rename itself survives a crash.
+func replaceFile(src, dst string) error {
+	if runtime.GOOS == "windows" {
+		var err error
+		for attempt := 0; attempt < 10; attempt++ {
+			if err = os.Rename(src, dst); err == nil || !errors.Is(err, fs.ErrPermission) {
+				return err
+			}
+			time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+		}
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// readByteRange reads up to limit bytes starting at offset, seeking rather
+// than loading the whole file. A negative limit reads to the end of the file.
+// It returns the content with the half-open byte range actually read and the
+// file size.
+func readByteRange(files FileService, path string, offset, limit int64) ([]byte, int64, int64, int64, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	size := info.Size()
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > size {
+		return nil, 0, 0, 0, fmt.Errorf("offset %d is beyond the end of the file (%d bytes)", offset, size)
+	}
+
+	end := size
+	if limit >= 0 && offset+limit < size {
+		end = offset + limit
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	content := make([]byte, end-offset)
+	n, err := io.ReadFull(file, content)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, 0, 0, 0, err
+	}
+	return content[:n], offset, offset + int64(n), size, nil
+}
+
+// readLineRange returns lines startLine through endLine (1-based, inclusive)
+// by streaming the file. A zero startLine means the first line and a zero
+// endLine the last. It returns the numbers of the first and last line read,
+// and stops early, reporting truncated, once maxBytes have been collected; the
+// last line may then be cut short.
+func readLineRange(files FileService, path string, startLine, endLine int, maxBytes int64) ([]byte, int, int, bool, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer file.Close()
+
+	if startLine < 1 {
+		startLine = 1
+	}
+
+	var content bytes.Buffer
+	reader := bufio.NewReader(file)
+	lineNum, last := 0, 0
+	midLine, truncated := false, false
+
+	// ReadSlice rather than ReadBytes, so one huge line is never buffered
+	// whole.
+	for !truncated {
+		chunk, err := reader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if !midLine {
+				lineNum++
+				if endLine != 0 && lineNum > endLine {
+					break
+				}
+			}
+			midLine = chunk[len(chunk)-1] != '\n'
+
+			if lineNum >= startLine {
+				if room := maxBytes - int64(content.Len()); int64(len(chunk)) > room {
+					chunk, truncated = chunk[:room], true
+				}
+				if len(chunk) > 0 {
+					content.Write(chunk)
+					last = lineNum
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, 0, 0, false, err
+		}
+	}
+
+	if startLine > lineNum {
+		return nil, 0, 0, false, fmt.Errorf("start_line %d is beyond the end of the file (%d lines)", startLine, lineNum)
+	}
+	if truncated {
+		return trimIncompleteRune(content.Bytes()), startLine, last, true, nil
+	}
+	return content.Bytes(), startLine, last, false, nil
+}
+
+// isBinaryFile classifies a file by its first few kilobytes.
+func isBinaryFile(files FileService, path string) bool {
+	sample, err := readFilePrefix(files, path, 8000)
+	if err != nil {
+		return false
+	}
+	return isBinaryContent(trimIncompleteRune(sample))
+}
+
+// readFilePrefix returns at most n bytes from the start of a file.
+func readFilePrefix(files FileService, path string, n int) ([]byte, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, n)
+	read, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+// trimIncompleteRune drops a multi-byte UTF-8 sequence cut off at the end of
+// a sample, so a truncated read of a text file is not mistaken for binary.
+func trimIncompleteRune(data []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		start := len(data) - i
+		if utf8.RuneStart(data[start]) {
+			if !utf8.FullRune(data[start:]) {
+				return data[:start]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// fileURIToPath converts a file:// URI into a local path, decoding percent
+// escapes. Both file:///path and file://localhost/path are accepted; any
+// other host is rejected since only local files can be served.
+func fileURIToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URI: %v", err)
+	}
+
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("Invalid URI scheme, expected file://")
+	}
+
+	if u.Opaque != "" {
+		return "", fmt.Errorf("Invalid file URI, expected file:///absolute/path")
+	}
+
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("Invalid file URI host %q, only local files are served", u.Host)
+	}
+
+	// u.Path is already percent-decoded.
+	path := u.Path
+	if path == "" {
+		return "", fmt.Errorf("Invalid file URI: empty path")
+	}
+
+	// file:///C:/dir on Windows decodes to /C:/dir.
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+
+	return filepath.FromSlash(path), nil
+}
+
+// pathToFileURI builds a file:// URI for an absolute local path, escaping
+// characters such as spaces and '#' so the URI parses back to the same path.
+func pathToFileURI(absPath string) string {
+	path := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path}
+	return u.String()
+}
+
+// resourceURI is the URI resources/list and friends give absPath: a file://
+// URI, or with -base-url the base followed by the root name and the path
+// within it, so that clients do not learn where the roots are on disk.
+func (s *MCPServer) resourceURI(absPath string) string {
+	root, ok := s.rootFor(absPath)
+	if s.baseURL == "" || !ok {
+		return pathToFileURI(absPath)
+	}
+
+	uri := s.baseURL + url.PathEscape(root.Name)
+	if relPath, err := filepath.Rel(root.Dir, absPath); err == nil && relPath != "." {
+		for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+			uri += "/" + url.PathEscape(part)
+		}
+	}
+	return uri
+}
+
+// resourcePath maps a URI from resourceURI back to a local path. The result
+// still has to pass the usual access checks.
+func (s *MCPServer) resourcePath(uri string) (string, error) {
+	if s.baseURL == "" {
+		return fileURIToPath(uri)
+	}
+
+	rest, ok := strings.CutPrefix(uri, s.baseURL)
+	if !ok || rest == "" {
+		return "", fmt.Errorf("Invalid URI, expected %s<root>/<path>", s.baseURL)
+	}
+	if strings.ContainsAny(rest, "?#") {
+		return "", fmt.Errorf("Invalid URI: query and fragment are not supported")
+	}
+
+	parts := strings.Split(rest, "/")
+	for i, part := range parts {
+		decoded, err := url.PathUnescape(part)
+		if err != nil {
+			return "", fmt.Errorf("Invalid URI: %v", err)
+		}
+		parts[i] = decoded
+	}
+
+	for _, root := range s.roots {
+		if root.Name == parts[0] {
+			return filepath.Join(append([]string{root.Dir}, parts[1:]...)...), nil
+		}
+	}
+	return "", fmt.Errorf("Invalid URI: unknown root %q", parts[0])
+}
+
+// parseBaseURL checks a -base-url value and returns it ending in a slash,
+// ready to have a root name appended.
+func parseBaseURL(base string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Scheme == "file" {
+		return "", fmt.Errorf("must have a scheme other than file, e.g. mcpfs://")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("must not have a query or fragment")
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base, nil
+}
+
+// isValidMimeType accepts strings of the form type/subtype with optional
+// parameters, as a sanity check on client supplied overrides.
+func isValidMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(mediaType, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// isTextMimeType reports whether content of this MIME type can be sent as
+// text rather than a base64 blob.
+func isTextMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml", "application/yaml", "application/toml":
+		return true
+	}
+	return false
+}
+
+// projectConfigFiles maps well-known file names to what they tell an agent
+// about the project.
+var projectConfigFiles = map[string]string{
+	"go.mod":             "Go module",
+	"package.json":       "Node.js package",
+	"Cargo.toml":         "Rust crate",
+	"pyproject.toml":     "Python project",
+	"setup.py":           "Python package",
+	"requirements.txt":   "Python dependencies",
+	"pom.xml":            "Maven project",
+	"build.gradle":       "Gradle project",
+	"Gemfile":            "Ruby dependencies",
+	"composer.json":      "PHP package",
+	"CMakeLists.txt":     "CMake project",
+	"Makefile":           "Make build",
+	"Dockerfile":         "Docker image",
+	"docker-compose.yml": "Docker Compose",
+	"tsconfig.json":      "TypeScript config",
+	".gitignore":         "Git ignore rules",
+	".editorconfig":      "Editor config",
+}
+
+// maxTOCFiles bounds how many files project_toc inspects on large trees.
+const maxTOCFiles = 20000
+
+// gitignoreRule is one pattern line of a .gitignore file, matched against
+// slash-separated paths relative to the directory holding that file.
+type gitignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// gitignoreMatcher applies the .gitignore files of one served root. Files
+// are loaded lazily as the walk reaches their directory, and rules in deeper
+// files override those above them, as in git.
+type gitignoreMatcher struct {
+	files   FileService
+	root    string
+	enabled bool
+	rules   map[string][]gitignoreRule
+}
+
+// newGitignoreMatcher returns a matcher for walks starting at path. VCS
+// directories are always skipped; .gitignore files only count with
+// -respect-gitignore.
+func (s *MCPServer) newGitignoreMatcher(path string) *gitignoreMatcher {
+	root, ok := s.rootFor(path)
+	if !ok {
+		root.Dir = path
+	}
+	return &gitignoreMatcher{
+		files:   s.files,
+		root:    root.Dir,
+		enabled: s.respectGitignore,
+		rules:   make(map[string][]gitignoreRule),
+	}
+}
+
+// skip is called from filepath.WalkDir callbacks. It reports whether the
+// entry should be left out, along with the value the callback should return
+// for it.
+func (m *gitignoreMatcher) skip(path string, d fs.DirEntry, walkRoot string) (bool, error) {
+	if path == walkRoot {
+		return false, nil
+	}
+	if d.IsDir() && isVCSDir(d.Name()) {
+		return true, filepath.SkipDir
+	}
+	if m.ignored(path, d.IsDir()) {
+		if d.IsDir() {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *gitignoreMatcher) ignored(path string, isDir bool) bool {
+	if !m.enabled {
+		return false
+	}
+
+	relPath, err := filepath.Rel(m.root, path)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	ignored := false
+	dir := m.root
+	for i := range parts {
+		subPath := strings.Join(parts[i:], "/")
+		for _, rule := range m.rulesFor(dir) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(subPath) {
+				ignored = !rule.negate
+			}
+		}
+		dir = filepath.Join(dir, parts[i])
+	}
+	return ignored
+}
+
+func (m *gitignoreMatcher) rulesFor(dir string) []gitignoreRule {
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+
+	var rules []gitignoreRule
+	if data, err := m.files.ReadFile(filepath.Join(dir, ".gitignore")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if rule, ok := parseGitignoreLine(line); ok {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	m.rules[dir] = rules
+	return rules
+}
+
+// parseGitignoreLine compiles one .gitignore line. Patterns without a slash
+// match a name at any depth; patterns with one are anchored to the
+// .gitignore's directory. A trailing slash matches directories only.
+func parseGitignoreLine(line string) (gitignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return gitignoreRule{}, false
+	}
+
+	var rule gitignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return gitignoreRule{}, false
+	}
+
+	pattern, err := globToRegexp(line, anchored)
+	if err != nil {
+		return gitignoreRule{}, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+// globToRegexp compiles a glob with doublestar semantics for matching
+// slash-separated relative paths: "*" and "?" stay within one path element,
+// "**" spans any number of directories and "[...]" is a character class
+// ("[!...]" negated). An unanchored glob may match at any depth.
+func globToRegexp(glob string, anchored bool) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+func isVCSDir(name string) bool {
+	return name == ".git" || name == ".hg" || name == ".svn"
+}
+
+// describeDirectory guesses a one-line description for a directory from the
+// first prose line of its README, or failing that from a Go package comment.
+// Only files that pass entryAllowed are read, as read_file would check them.
+// The line it returns is audited as content of that file.
+func (s *MCPServer) describeDirectory(dir string) string {
+	entries, _ := s.files.ReadDir(dir)
+	readable := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.IsDir() && s.entryAllowed(filepath.Join(dir, entry.Name()), entry) {
+			readable[entry.Name()] = true
+		}
+	}
+
+	for _, name := range []string{"README.md", "README", "README.txt", "readme.md"} {
+		if !readable[name] {
+			continue
+		}
+		content, err := readFilePrefix(s.files, filepath.Join(dir, name), 4096)
+		if err != nil {
+			continue
+		}
+		if line := firstProseLine(string(trimIncompleteRune(content))); line != "" {
+			s.recordAudit("project_toc", s.relativePath(filepath.Join(dir, name)), "", len(line))
+			return line
+		}
+	}
+
+	for _, entry := range entries {
+		if !readable[entry.Name()] || filepath.Ext(entry.Name()) != ".go" {
+			continue
+		}
+		content, err := readFilePrefix(s.files, filepath.Join(dir, entry.Name()), 4096)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "// Package ") {
+				line = strings.TrimPrefix(line, "// ")
+				s.recordAudit("project_toc", s.relativePath(filepath.Join(dir, entry.Name())), "", len(line))
+				return line
+			}
+		}
+	}
+
+	return ""
+}
+
+// firstProseLine returns the first line of markdown that is not blank, a
+// heading, a badge/image or a code fence.
+func firstProseLine(text string) string {
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "![") || strings.HasPrefix(line, "[![") || strings.HasPrefix(line, "<") {
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
+// SecretRule is one entry in the scan_secrets rule table. Add new detectors
+// by appending to secretRules.
+type SecretRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+var secretRules = []SecretRule{
+	{"aws_access_key_id", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws_secret_access_key", regexp.MustCompile(`(?i)aws_secret_access_key\s*[:=]\s*['"]?[A-Za-z0-9/+=]{40}`)},
+	{"private_key", regexp.MustCompile(`-----BEGIN ((RSA|EC|DSA|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"github_token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"slack_token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"bearer_token", regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]{20,}=*`)},
+	{"password_assignment", regexp.MustCompile(`(?i)\b(password|passwd|pwd)\s*[:=]\s*['"]?[^\s'"]{4,}`)},
+	{"api_key_assignment", regexp.MustCompile(`(?i)\b(api[_-]?key|secret[_-]?key|access[_-]?token|auth[_-]?token)\s*[:=]\s*['"]?[A-Za-z0-9_\-]{16,}`)},
+}
+
+// scanFileForSecrets returns one finding per matching rule per line. Binary
+// files yield no findings.
+func scanFileForSecrets(files FileService, path string) ([]SecretFinding, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	sample, _ := reader.Peek(8000)
+	if isBinaryContent(trimIncompleteRune(sample)) {
+		return nil, nil
+	}
+
+	var findings []SecretFinding
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		for _, rule := range secretRules {
+			if rule.Pattern.MatchString(line) {
+				findings = append(findings, SecretFinding{Line: lineNum, Rule: rule.Name})
+			}
+		}
+	}
+	return findings, scanner.Err()
+}
+
+// maxMatchLineLength caps how much of a matching line search_content
+// returns, so minified files do not flood the client.
+const maxMatchLineLength = 500
+
+// searchFileContent calls match for every line of path that re matches,
+// stopping early and reporting true when match returns false. Files with a
+// NUL byte near the start are treated as binary and skipped.
+func searchFileContent(files FileService, path string, re *regexp.Regexp, match func(line int, text string) bool) (bool, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	sample, _ := reader.Peek(8000)
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return false, nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if !re.MatchString(line) {
+			continue
+		}
+		if len(line) > maxMatchLineLength {
+			line = string(trimIncompleteRune([]byte(line[:maxMatchLineLength]))) + "..."
+		}
+		if !match(lineNum, line) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// copyFile copies a regular file to dst through a temporary file in the
+// destination directory, so dst is either complete or untouched. The copy
+// keeps the source's permission bits.
+func copyFile(files FileService, src, dst string) error {
+	in, err := files.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return files.WriteFile(dst, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// copyTree copies the directory src to dst, which may already exist when
+// overwrite is set, keeping permission bits. Symlinks are copied as links,
+// never followed. It returns the number of files and links copied.
+func copyTree(ctx context.Context, files FileService, src, dst string, overwrite bool) (int, error) {
+	copied := 0
+	err := files.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := files.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := files.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if _, err := files.Lstat(target); err == nil {
+				if !overwrite {
+					return fmt.Errorf("%s already exists", target)
+				}
+				if err := files.Remove(target); err != nil {
+					return err
+				}
+			}
+			if err := files.Symlink(link, target); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			if _, err := files.Lstat(target); err == nil && !overwrite {
+				return fmt.Errorf("%s already exists", target)
+			}
+			if err := copyFile(files, p, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, sockets and pipes have no content to copy.
+			return nil
+		}
+
+		copied++
+		return nil
+	})
+	return copied, err
+}
+
+// openZip opens a zip archive for reading in place. The returned file must
+// be closed once the reader is no longer needed.
+func openZip(files FileService, path string) (*zip.Reader, File, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	reader, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return reader, file, nil
+}
+
+// fileETag identifies a version of a file by its size and modification
+// time, which is cheap and changes with every write that matters. A non-empty
+// variant, describing a range or transformation of the content, is folded in
+// so that each form of a read gets its own etag.
+func fileETag(info fs.FileInfo, variant string) string {
+	if variant == "" {
+		return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf(`"%x-%x-%08x"`, info.Size(), info.ModTime().UnixNano(), crc32.ChecksumIEEE([]byte(variant)))
+}
+
+// readVariant describes the read_file arguments that change what is sent for
+// a file, for fileETag. A plain read has no variant.
+func readVariant(args map[string]interface{}) string {
+	var parts []string
+	for _, name := range []string{"mimeType", "offset", "limit", "start_line", "end_line", "line_numbers", "encoding", "decompress"} {
+		if value, ok := args[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%v", name, value))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// encodingGzip is the one content encoding read_file and resources/read
+// offer for large text.
+const encodingGzip = "gzip"
+
+// gzipBase64IfSmaller gzips text for the given encoding and returns it
+// base64-encoded, but only when that is shorter than sending the text as is.
+func gzipBase64IfSmaller(text []byte, encoding string) (string, bool) {
+	if encoding != encodingGzip {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(text)
+	if err := zw.Close(); err != nil {
+		return "", false
+	}
+
+	if base64.StdEncoding.EncodedLen(buf.Len()) >= len(text) {
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), true
+}
+
+// gzipMeta marks a blob as gzipped so clients know to gunzip it, and gives
+// the size it expands to.
+func gzipMeta(size int) map[string]interface{} {
+	return map[string]interface{}{
+		"encoding":     encodingGzip,
+		"originalSize": size,
+	}
+}
+
+// hashAlgorithms maps the algorithm names accepted by file_hash to their
+// constructors.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// readHeadLines returns the first n lines of a file. The total line count is
+// only known, and returned, when the file ends within those lines; otherwise
+// it is -1. Reading more than limit bytes fails with a FileTooLargeError.
+func readHeadLines(files FileService, path string, n int, limit int64) ([]byte, int, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer file.Close()
+
+	var content bytes.Buffer
+	reader := bufio.NewReader(file)
+	// ReadSlice rather than ReadBytes, so the limit is checked every buffer
+	// and one huge line is never read whole.
+	for read := 0; read < n; {
+		chunk, err := reader.ReadSlice('\n')
+		content.Write(chunk)
+		if int64(content.Len()) > limit {
+			return nil, -1, &FileTooLargeError{Size: int64(content.Len()), Limit: limit}
+		}
+		if len(chunk) > 0 && chunk[len(chunk)-1] == '\n' {
+			read++
+		}
+		if err == io.EOF {
+			return content.Bytes(), countLines(content.Bytes()), nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, -1, err
+		}
+	}
+
+	if _, err := reader.Peek(1); err == io.EOF {
+		return content.Bytes(), n, nil
+	}
+	return content.Bytes(), -1, nil
+}
+
+// readTailLines returns the last n lines of a file, reading backwards from
+// the end in chunks so the start of a large file is never touched. As with
+// readHeadLines, the total line count is -1 unless the whole file was read.
+func readTailLines(files FileService, path string, n int, limit int64) ([]byte, int, error) {
+	file, err := files.Open(path)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	const chunkSize = 8192
+	var data []byte
+	for pos := info.Size(); pos > 0; {
+		step := min(int64(chunkSize), pos)
+		pos -= step
+
+		chunk := make([]byte, step)
+		if _, err := file.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return nil, -1, err
+		}
+		data = append(chunk, data...)
+
+		// A newline ending the file terminates the last line rather than
+		// starting a new one.
+		body := bytes.TrimSuffix(data, []byte("\n"))
+		if bytes.Count(body, []byte("\n")) >= n {
+			start := len(body)
+			for i := 0; i < n; i++ {
+				start = bytes.LastIndexByte(body[:start], '\n')
+			}
+			data = data[start+1:]
+			if int64(len(data)) > limit {
+				return nil, -1, &FileTooLargeError{Size: int64(len(data)), Limit: limit}
+			}
+			return data, -1, nil
+		}
+
+		if int64(len(data)) > limit {
+			return nil, -1, &FileTooLargeError{Size: int64(len(data)), Limit: limit}
+		}
+	}
+
+	return data, countLines(data), nil
+}
+
+// numberLines prefixes each line of content with its number, counting from
+// first, right-aligned to the widest number and followed by a tab as cat -n
+// does. A missing final newline stays missing.
+func numberLines(content []byte, first int) string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	width := len(strconv.Itoa(first + len(lines) - 1))
+	var b strings.Builder
+	for i, line := range lines {
+		fmt.Fprintf(&b, "%*d\t%s", width, first+i, line)
+	}
+	return b.String()
+}
+
+// countLines counts the lines in content, including a final line that has
+// no trailing newline.
+func countLines(content []byte) int {
+	n := bytes.Count(content, []byte("\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// watchFilePollInterval is how often watch_file stats the file when no
+// filesystem watcher is available; with one, it still re-checks every
+// watchFileSafetyInterval in case an event was missed.
+const (
+	watchFilePollInterval   = 250 * time.Millisecond
+	watchFileSafetyInterval = 2 * time.Second
+)
+
+// fileState is what watch_file compares to decide whether a file changed.
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFileState(files FileService, path string) fileState {
+	info, err := files.Stat(path)
+	if err != nil {
+		return fileState{size: -1}
+	}
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// change names the event that turned f into next, or returns "" if the file
+// looks the same.
+func (f fileState) change(next fileState) string {
+	switch {
+	case !f.exists && next.exists:
+		return "created"
+	case f.exists && !next.exists:
+		return "deleted"
+	case f.exists && (f.size != next.size || !f.modTime.Equal(next.modTime)):
+		return "modified"
+	}
+	return ""
+}
+
+// replaceLiteral replaces the first occurrence of search, or every
+// non-overlapping one when all is set, and reports how many it replaced.
+func replaceLiteral(content, search, replace []byte, all bool) ([]byte, int) {
+	n := bytes.Count(content, search)
+	if n == 0 {
+		return content, 0
+	}
+	if !all {
+		n = 1
+	}
+	return bytes.Replace(content, search, replace, n), n
+}
+
+// replaceRegexp is replaceLiteral for a regular expression, expanding $1 and
+// ${name} in replace as regexp.Regexp.ReplaceAll does.
+func replaceRegexp(content []byte, re *regexp.Regexp, replace []byte, all bool) ([]byte, int) {
+	limit := 1
+	if all {
+		limit = -1
+	}
+	matches := re.FindAllSubmatchIndex(content, limit)
+	if len(matches) == 0 {
+		return content, 0
+	}
+
+	var out []byte
+	last := 0
+	for _, match := range matches {
+		out = append(out, content[last:match[0]]...)
+		out = re.Expand(out, replace, content, match)
+		last = match[1]
+	}
+	return append(out, content[last:]...), len(matches)
+}
+
+// describeReplaced notes, for a dry-run report, what existing file a write
+// to path would replace.
+func describeReplaced(files FileService, path string) string {
+	info, err := files.Lstat(path)
+	switch {
+	case err != nil:
+		return ""
+	case info.IsDir():
+		return ", merging into the existing directory"
+	default:
+		return fmt.Sprintf(", replacing the existing %s", formatByteSize(info.Size()))
+	}
+}
+
+// dirTreeStats counts what lies below a directory, for dry-run reports.
+type dirTreeStats struct {
+	files, dirs int
+	bytes       int64
+}
+
+func (t dirTreeStats) String() string {
+	return fmt.Sprintf("%d files and %d subdirectories (%s)", t.files, t.dirs, formatByteSize(t.bytes))
+}
+
+// treeStats walks dir without following symlinks, which count as files.
+func treeStats(files FileService, dir string) (dirTreeStats, error) {
+	var stats dirTreeStats
+	err := files.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case p == dir:
+		case d.IsDir():
+			stats.dirs++
+		default:
+			stats.files++
+			if info, err := d.Info(); err == nil {
+				stats.bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// formatByteSize renders a byte count in the largest of B, KB, MB, GB and TB
+// that keeps the number at least 1, using 1024-byte units.
+func formatByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KB", "MB", "GB", "TB"}
+	i := -1
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[i])
+}
+
+// countFileStats counts r for file_stats. A line is ended by LF or CRLF,
+// and a last line without one still counts. Words are runs of non-space
+// characters. A BOM decides the encoding; without one the content is taken
+// as UTF-8, and characters are counted in whichever encoding applies.
+func countFileStats(ctx context.Context, r io.Reader) (FileStats, error) {
+	counter := &countingReader{r: r}
+	br := bufio.NewReaderSize(counter, 64*1024)
+
+	stats := FileStats{Encoding: "ascii"}
+	readRune := br.ReadRune
+	if bom, _ := br.Peek(3); bytes.HasPrefix(bom, []byte(utf8BOM)) {
+		br.Discard(len(utf8BOM))
+		stats.Encoding = "utf-8-bom"
+	} else if bytes.HasPrefix(bom, []byte{0xFF, 0xFE}) || bytes.HasPrefix(bom, []byte{0xFE, 0xFF}) {
+		order := binary.ByteOrder(binary.LittleEndian)
+		stats.Encoding = "utf-16le"
+		if bom[0] == 0xFE {
+			order, stats.Encoding = binary.BigEndian, "utf-16be"
+		}
+		br.Discard(2)
+		readRune = utf16RuneReader(br, order)
+	}
+
+	var lf, crlf int64
+	inWord, lineOpen, prevCR, invalid := false, false, false, false
+	for {
+		if stats.Chars%65536 == 0 {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+		}
+
+		c, size, err := readRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Chars++
+
+		switch {
+		case c == utf8.RuneError && size == 1:
+			invalid = true
+		case c >= utf8.RuneSelf && stats.Encoding == "ascii":
+			stats.Encoding = "utf-8"
+		}
+
+		if c == '\n' {
+			stats.Lines++
+			if prevCR {
+				crlf++
+			} else {
+				lf++
+			}
+		}
+		lineOpen = c != '\n'
+		prevCR = c == '\r'
+
+		if unicode.IsSpace(c) {
+			inWord = false
+		} else if !inWord {
+			inWord = true
+			stats.Words++
+		}
+	}
+	if lineOpen {
+		stats.Lines++
+	}
+
+	stats.Bytes = counter.n
+	if invalid {
+		stats.Encoding = "unknown"
+	}
+	switch {
+	case lf > 0 && crlf > 0:
+		stats.LineEndings = "mixed"
+	case crlf > 0:
+		stats.LineEndings = "crlf"
+	case lf > 0:
+		stats.LineEndings = "lf"
+	default:
+		stats.LineEndings = "none"
+	}
+	return stats, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// utf16RuneReader decodes UTF-16 from br one rune at a time, joining
+// surrogate pairs. Unpaired surrogates and a trailing odd byte come back as
+// utf8.RuneError with size 1, as bufio.Reader.ReadRune reports bad UTF-8.
+func utf16RuneReader(br *bufio.Reader, order binary.ByteOrder) func() (rune, int, error) {
+	readUnit := func() (uint16, bool, error) {
+		var unit [2]byte
+		n, err := io.ReadFull(br, unit[:])
+		if err == io.ErrUnexpectedEOF {
+			return 0, n == 1, nil
+		}
+		return order.Uint16(unit[:]), false, err
+	}
+
+	return func() (rune, int, error) {
+		first, odd, err := readUnit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if odd {
+			return utf8.RuneError, 1, nil
+		}
+		if !utf16.IsSurrogate(rune(first)) {
+			return rune(first), 2, nil
+		}
+
+		next, err := br.Peek(2)
+		if len(next) == 2 {
+			if c := utf16.DecodeRune(rune(first), rune(order.Uint16(next))); c != utf8.RuneError {
+				br.Discard(2)
+				return c, 4, nil
+			}
+		}
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		return utf8.RuneError, 1, nil
+	}
+}
+
+// getMimeType maps a file extension to a MIME type. Configured overrides
+// come first, then the built-in table, then the system MIME database.
+func (s *MCPServer) getMimeType(ext string) string {
+	if mimeType, ok := s.mimeOverrides[strings.ToLower(ext)]; ok {
+		return mimeType
+	}
+
+	switch strings.ToLower(ext) {
+	case ".txt":
+		return "text/plain"
+	case ".md", ".markdown":
+		return "text/markdown"
+	case ".json":
+		return "application/json"
+	case ".xml":
+		return "application/xml"
+	case ".html", ".htm":
+		return "text/html"
+	case ".css":
+		return "text/css"
+	case ".js":
+		return "application/javascript"
+	case ".go":
+		return "text/x-go"
+	case ".py":
+		return "text/x-python"
+	case ".java":
+		return "text/x-java"
+	case ".c", ".h":
+		return "text/x-c"
+	case ".cpp", ".cc", ".hpp":
+		return "text/x-c++"
+	case ".rs":
+		return "text/x-rust"
+	case ".sh":
+		return "text/x-shellscript"
+	case ".yaml", ".yml":
+		return "application/yaml"
+	case ".toml":
+		return "application/toml"
+	}
+
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return stripMimeParams(mimeType)
+	}
+	return "application/octet-stream"
+}
+
+// sniffLen is how much content http.DetectContentType looks at.
+const sniffLen = 512
+
+// detectMimeType falls back to sniffing the leading bytes of the content
+// when the extension alone says nothing, so extensionless text files are
+// not reported as application/octet-stream.
+func (s *MCPServer) detectMimeType(ext string, data []byte) string {
+	mimeType := s.getMimeType(ext)
+	if mimeType != "application/octet-stream" || len(data) == 0 {
+		return mimeType
 	}
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	return stripMimeParams(http.DetectContentType(data))
+}
 
-	// List directory contents
-	entries, err := os.ReadDir(absPath)
+// detectFileMimeType is detectMimeType for a file on disk.
+func (s *MCPServer) detectFileMimeType(path string) string {
+	data, err := readFilePrefix(s.files, path, sniffLen)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return s.sendToolResult(id, fmt.Sprintf("Directory not found: %s", targetDir), true)
-		}
-		return s.sendToolResult(id, fmt.Sprintf("Failed to list directory: %v", err), true)
+		return s.getMimeType(filepath.Ext(path))
 	}
+	return s.detectMimeType(filepath.Ext(path), data)
+}
 
-	var result strings.Builder
-	relPath, _ := filepath.Rel(s.baseDir, absPath)
-	if relPath == "." {
-		result.WriteString("Contents of base directory:\n")
-	} else {
-		result.WriteString(fmt.Sprintf("Contents of %s:\n", relPath))
+// stripMimeParams drops parameters such as "; charset=utf-8" so detected
+// types look like the ones from the explicit table.
+func stripMimeParams(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
 	}
+	return mediaType
+}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			result.WriteString(fmt.Sprintf("📁 %s/\n", entry.Name()))
-		} else {
-			info, err := entry.Info()
-			if err == nil {
-				result.WriteString(fmt.Sprintf("📄 %s (%d bytes)\n", entry.Name(), info.Size()))
-			} else {
-				result.WriteString(fmt.Sprintf("📄 %s\n", entry.Name()))
-			}
-		}
+func mustMarshal(v interface{}) []byte {
+	if v == nil {
+		return []byte("{}")
 	}
-
-	return s.sendToolResult(id, result.String(), false)
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
 }
 
-func (s *MCPServer) handleSearchFilesTool(id interface{}, args map[string]interface{}) error {
-	patternArg, ok := args["pattern"]
-	if !ok {
-		return s.sendError(id, -32602, "Missing required argument: pattern")
+// logLevel is the minimum level written to the log. It is a LevelVar so it
+// can be changed while the server runs.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel accepts the level names used by -log-level and LOG_LEVEL.
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
 	}
+	return 0, fmt.Errorf("unknown log level %q: must be debug, info, warn or error", name)
+}
 
-	pattern, ok := patternArg.(string)
-	if !ok {
-		return s.sendError(id, -32602, "Invalid pattern argument: must be string")
+// mcpLogLevels maps the syslog-style levels of logging/setLevel onto slog
+// levels. The server itself logs no higher than error, so the levels above
+// it silence notifications/message entirely.
+var mcpLogLevels = map[string]slog.Level{
+	"debug":     slog.LevelDebug,
+	"info":      slog.LevelInfo,
+	"notice":    slog.LevelInfo + 2,
+	"warning":   slog.LevelWarn,
+	"error":     slog.LevelError,
+	"critical":  slog.LevelError + 4,
+	"alert":     slog.LevelError + 8,
+	"emergency": slog.LevelError + 12,
+}
+
+// mcpLogLevelName is the notifications/message level for a slog level.
+func mcpLogLevelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "debug"
+	case level < slog.LevelWarn:
+		return "info"
+	case level < slog.LevelError:
+		return "warning"
 	}
+	return "error"
+}
 
-	var matches []string
+// clientLogHandler writes records to the stderr handler and also forwards
+// those at or above the client's chosen level as notifications/message.
+type clientLogHandler struct {
+	next   slog.Handler
+	server *MCPServer
+	attrs  []slog.Attr
+}
 
-	err := filepath.WalkDir(s.baseDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+func (h *clientLogHandler) clientEnabled(level slog.Level) bool {
+	return h.server.clientLogEnabled.Load() && level >= h.server.clientLogLevel.Level()
+}
 
-		if d.IsDir() {
-			return nil
-		}
+func (h *clientLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level) || h.clientEnabled(level)
+}
 
-		matched, err := filepath.Match(pattern, d.Name())
-		if err != nil {
+func (h *clientLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if h.next.Enabled(ctx, record.Level) {
+		if err := h.next.Handle(ctx, record); err != nil {
 			return err
 		}
+	}
 
-		if matched {
-			relPath, err := filepath.Rel(s.baseDir, path)
-			if err != nil {
-				return err
-			}
-			matches = append(matches, relPath)
-		}
-
+	if !h.clientEnabled(record.Level) {
 		return nil
-	})
+	}
 
-	if err != nil {
-		return s.sendToolResult(id, fmt.Sprintf("Search failed: %v", err), true)
+	data := map[string]interface{}{"msg": record.Message}
+	addAttr := func(attr slog.Attr) bool {
+		value := attr.Value.Resolve().Any()
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		data[attr.Key] = value
+		return true
+	}
+	for _, attr := range h.attrs {
+		addAttr(attr)
 	}
+	record.Attrs(addAttr)
 
-	var result strings.Builder
-	result.WriteString(fmt.Sprintf("Files matching pattern '%s':\n", pattern))
+	return h.server.sendNotification("notifications/message", LogMessageParams{
+		Level:  mcpLogLevelName(record.Level),
+		Logger: serverName,
+		Data:   data,
+	})
+}
 
-	if len(matches) == 0 {
-		result.WriteString("No files found matching the pattern.")
-	} else {
-		for _, match := range matches {
-			result.WriteString(fmt.Sprintf("📄 %s\n", match))
-		}
+func (h *clientLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &clientLogHandler{
+		next:   h.next.WithAttrs(attrs),
+		server: h.server,
+		attrs:  append(append([]slog.Attr{}, h.attrs...), attrs...),
 	}
+}
 
-	return s.sendToolResult(id, result.String(), false)
+func (h *clientLogHandler) WithGroup(name string) slog.Handler {
+	return &clientLogHandler{next: h.next.WithGroup(name), server: h.server, attrs: h.attrs}
 }
 
-func (s *MCPServer) handleMessage(msg JSONRPCMessage) error {
-	switch msg.Method {
-	case "initialize":
-		var params InitializeParams
-		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
-			return s.sendError(msg.ID, -32602, "Invalid initialize parameters")
-		}
-		return s.handleInitialize(msg.ID, params)
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
-	case "notifications/initialized":
-		s.handleNotificationInitialized()
-		return nil
+// Config holds the settings that can be loaded from a -config file. Every
+// field is optional, and flags given on the command line override it.
+type Config struct {
+	Roots        []ConfigRoot      `json:"roots"`
+	Include      []string          `json:"include"`
+	Exclude      []string          `json:"exclude"`
+	MaxFileSize  *int64            `json:"maxFileSize"`
+	ReadOnly     *bool             `json:"readOnly"`
+	LogLevel     string            `json:"logLevel"`
+	MimeTypes    map[string]string `json:"mimeTypes"`
+	EnableTools  []string          `json:"enableTools"`
+	DisableTools []string          `json:"disableTools"`
+}
 
-	case "resources/list":
-		return s.handleListResources(msg.ID)
+// ConfigRoot is one served directory in a config file. The name is optional
+// and defaults to the directory's base name, as for positional arguments.
+type ConfigRoot struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
 
-	case "resources/read":
-		var params ReadResourceParams
-		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
-			return s.sendError(msg.ID, -32602, "Invalid read resource parameters")
+// loadConfig reads a JSON or YAML (by .yaml/.yml extension) config file.
+// YAML is converted to JSON first so both formats share one set of field
+// names and reject unknown keys alike. Relative root paths are taken
+// relative to the config file.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %v", err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %v", err)
 		}
-		return s.handleReadResource(msg.ID, params)
+	}
 
-	case "tools/list":
-		return s.handleListTools(msg.ID)
+	var cfg Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
 
-	case "tools/call":
-		var params CallToolParams
-		if err := json.Unmarshal(mustMarshal(msg.Params), &params); err != nil {
-			return s.sendError(msg.ID, -32602, "Invalid call tool parameters")
+	for i := range cfg.Roots {
+		if cfg.Roots[i].Path != "" && !filepath.IsAbs(cfg.Roots[i].Path) {
+			cfg.Roots[i].Path = filepath.Join(filepath.Dir(path), cfg.Roots[i].Path)
 		}
-		return s.handleCallTool(msg.ID, params)
-
-	default:
-		return s.sendError(msg.ID, -32601, fmt.Sprintf("Method not found: %s", msg.Method))
 	}
+	return &cfg, nil
 }
 
-func (s *MCPServer) Run() error {
-	log.Printf("MCP Server starting, serving directory: %s", s.baseDir)
-	log.Printf("Server ready, waiting for messages...")
+// validate checks every setting and reports all problems at once rather
+// than stopping at the first. Missing root directories are allowed when
+// they will be created.
+func (c *Config) validate(createDir bool) error {
+	var problems []string
 
-	for s.scanner.Scan() {
-		line := s.scanner.Text()
-		if line == "" {
+	names := make(map[string]bool)
+	for i, root := range c.Roots {
+		switch {
+		case root.Path == "":
+			problems = append(problems, fmt.Sprintf("roots[%d]: path is required", i))
+		case !createDir:
+			if info, err := os.Stat(root.Path); err != nil {
+				problems = append(problems, fmt.Sprintf("roots[%d]: directory does not exist: %s", i, root.Path))
+			} else if !info.IsDir() {
+				problems = append(problems, fmt.Sprintf("roots[%d]: not a directory: %s", i, root.Path))
+			}
+		}
+		if root.Name == "" {
 			continue
 		}
+		if root.Name == "." || root.Name == ".." || strings.ContainsAny(root.Name, `/\`) {
+			problems = append(problems, fmt.Sprintf("roots[%d]: invalid name %q", i, root.Name))
+		} else if names[root.Name] {
+			problems = append(problems, fmt.Sprintf("roots[%d]: duplicate name %q", i, root.Name))
+		}
+		names[root.Name] = true
+	}
 
-		log.Printf("Received: %s", line)
+	for _, list := range []struct {
+		name  string
+		globs []string
+	}{{"include", c.Include}, {"exclude", c.Exclude}} {
+		for _, glob := range list.globs {
+			if _, err := compilePathGlob(glob); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid pattern %q", list.name, glob))
+			}
+		}
+	}
 
-		var msg JSONRPCMessage
-		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			log.Printf("Invalid JSON: %v", err)
-			continue
+	if c.MaxFileSize != nil && *c.MaxFileSize < 1 {
+		problems = append(problems, fmt.Sprintf("maxFileSize: must be positive, got %d", *c.MaxFileSize))
+	}
+
+	if c.LogLevel != "" {
+		if _, err := parseLogLevel(c.LogLevel); err != nil {
+			problems = append(problems, fmt.Sprintf("logLevel: %v", err))
 		}
+	}
 
-		if err := s.handleMessage(msg); err != nil {
-			log.Printf("Error handling message: %v", err)
+	exts := make([]string, 0, len(c.MimeTypes))
+	for ext := range c.MimeTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			problems = append(problems, fmt.Sprintf("mimeTypes: extension %q must start with a dot", ext))
+		}
+		if !isValidMimeType(c.MimeTypes[ext]) {
+			problems = append(problems, fmt.Sprintf("mimeTypes: invalid MIME type %q for %s", c.MimeTypes[ext], ext))
 		}
 	}
 
-	if err := s.scanner.Err(); err != nil {
-		return fmt.Errorf("scanner error: %v", err)
+	for _, list := range []struct {
+		name  string
+		tools []string
+	}{{"enableTools", c.EnableTools}, {"disableTools", c.DisableTools}} {
+		if _, err := parseToolList(list.tools); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", list.name, err))
+		}
 	}
 
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s):\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
 	return nil
 }
 
-// Utility Functions
+// settings are the options a config file can provide. main takes them from
+// the flags and lays the config file over them; server/restart does the same
+// with the file as it is then.
+type settings struct {
+	logLevel     string
+	readOnly     bool
+	maxFileSize  int64
+	include      string
+	exclude      string
+	enableTools  string
+	disableTools string
+	mimeTypes    mimeTypeFlags
+}
 
-func getMimeType(ext string) string {
-	switch strings.ToLower(ext) {
-	case ".txt", ".md", ".markdown":
-		return "text/plain"
-	case ".json":
-		return "application/json"
-	case ".xml":
-		return "application/xml"
-	case ".html", ".htm":
-		return "text/html"
-	case ".css":
-		return "text/css"
-	case ".js":
-		return "application/javascript"
-	case ".go":
-		return "text/plain"
-	case ".py":
-		return "text/plain"
-	case ".java":
-		return "text/plain"
-	case ".c", ".cpp", ".h":
-		return "text/plain"
-	default:
-		return "application/octet-stream"
+// withConfig returns st with each setting from cfg whose flag was not given
+// on the command line. -mime-type flags override the file per extension.
+func (st settings) withConfig(cfg *Config, setFlags map[string]bool) settings {
+	if cfg.LogLevel != "" && !setFlags["log-level"] {
+		st.logLevel = cfg.LogLevel
+	}
+	if cfg.ReadOnly != nil && !setFlags["read-only"] {
+		st.readOnly = *cfg.ReadOnly
+	}
+	if cfg.MaxFileSize != nil && !setFlags["max-file-size"] {
+		st.maxFileSize = *cfg.MaxFileSize
+	}
+	if cfg.Include != nil && !setFlags["include"] {
+		st.include = strings.Join(cfg.Include, ",")
+	}
+	if cfg.Exclude != nil && !setFlags["exclude"] {
+		st.exclude = strings.Join(cfg.Exclude, ",")
 	}
+	if cfg.EnableTools != nil && !setFlags["enable-tools"] {
+		st.enableTools = strings.Join(cfg.EnableTools, ",")
+	}
+	if cfg.DisableTools != nil && !setFlags["disable-tools"] {
+		st.disableTools = strings.Join(cfg.DisableTools, ",")
+	}
+
+	mimeTypes := make(mimeTypeFlags)
+	for ext, mimeType := range cfg.MimeTypes {
+		mimeTypes[strings.ToLower(ext)] = mimeType
+	}
+	maps.Copy(mimeTypes, st.mimeTypes)
+	st.mimeTypes = mimeTypes
+	return st
 }
 
-func mustMarshal(v interface{}) []byte {
-	if v == nil {
-		return []byte("{}")
+// applySettings checks all of st and only then puts it into effect, so a
+// bad value changes nothing. The log level is process-wide.
+func (s *MCPServer) applySettings(st settings) error {
+	level, err := parseLogLevel(st.logLevel)
+	if err != nil {
+		return fmt.Errorf("Invalid -log-level: %v", err)
 	}
-	data, err := json.Marshal(v)
+	if st.maxFileSize < 1 {
+		return fmt.Errorf("Invalid -max-file-size %d: must be positive", st.maxFileSize)
+	}
+	includeGlobs, err := parseGlobList(st.include)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Invalid -include: %v", err)
 	}
-	return data
+	excludeGlobs, err := parseGlobList(st.exclude)
+	if err != nil {
+		return fmt.Errorf("Invalid -exclude: %v", err)
+	}
+	var enabledTools map[string]bool
+	if st.enableTools != "" {
+		enabledTools, err = parseToolList(strings.Split(st.enableTools, ","))
+		if err != nil {
+			return fmt.Errorf("Invalid -enable-tools: %v", err)
+		}
+	}
+	disabledTools, err := parseToolList(strings.Split(st.disableTools, ","))
+	if err != nil {
+		return fmt.Errorf("Invalid -disable-tools: %v", err)
+	}
+
+	logLevel.Set(level)
+	s.readOnly = st.readOnly
+	s.maxFileSize = st.maxFileSize
+	s.includeGlobs = includeGlobs
+	s.excludeGlobs = excludeGlobs
+	s.enabledTools = enabledTools
+	s.disabledTools = disabledTools
+	s.mimeOverrides = make(map[string]string)
+	maps.Copy(s.mimeOverrides, st.mimeTypes)
+	return nil
+}
+
+// mimeTypeFlags collects repeated -mime-type ext=type flags.
+type mimeTypeFlags map[string]string
+
+func (m mimeTypeFlags) String() string {
+	parts := make([]string, 0, len(m))
+	for ext, mimeType := range m {
+		parts = append(parts, ext+"="+mimeType)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (m mimeTypeFlags) Set(value string) error {
+	ext, mimeType, ok := strings.Cut(value, "=")
+	if !ok || ext == "" || mimeType == "" {
+		return fmt.Errorf("expected ext=type")
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if !isValidMimeType(mimeType) {
+		return fmt.Errorf("invalid MIME type %q", mimeType)
+	}
+	m[strings.ToLower(ext)] = mimeType
+	return nil
+}
+
+// rootFlags collects repeated -root name=path flags.
+type rootFlags []Root
+
+func (r *rootFlags) String() string {
+	parts := make([]string, len(*r))
+	for i, root := range *r {
+		parts[i] = root.Name + "=" + root.Dir
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *rootFlags) Set(value string) error {
+	name, dir, ok := strings.Cut(value, "=")
+	if !ok || name == "" || dir == "" {
+		return fmt.Errorf("expected name=path")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid root name %q", name)
+	}
+	*r = append(*r, Root{Name: name, Dir: dir})
+	return nil
 }
 
 func main() {
-	// Default to current directory if no argument provided
-	baseDir := "."
-	if len(os.Args) > 1 {
-		baseDir = os.Args[1]
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [directory...]\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(out, "Serve local directories to MCP clients over stdio or HTTP.\n")
+		fmt.Fprintf(out, "Directories may be given as positional arguments, -dir or -root; the default is the current directory.\n\n")
+		fmt.Fprintf(out, "Flags:\n")
+		flag.PrintDefaults()
 	}
 
-	// Ensure the directory exists
-	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
-		log.Fatalf("Directory does not exist: %s", baseDir)
+	dirFlag := flag.String("dir", "", "Directory to serve; same as passing it as a positional argument")
+	showVersion := flag.Bool("version", false, "Print the server version and exit")
+	configPath := flag.String("config", "", "Load settings from a JSON or YAML file; flags given on the command line override it")
+	requireDir := flag.Bool("require-dir", false, "Fail every request with a clear error while the served directory is missing")
+	createDir := flag.Bool("create-dir", false, "Create the served directory if it is missing, at startup and on each re-check")
+	auditLog := flag.String("audit-log", "", "Append a JSON line for every file read to this file")
+	noStats := flag.Bool("no-stats", false, "Disable the server/stats method, which reports uptime, request and byte counters and the served roots")
+	allowControl := flag.Bool("allow-control", false, "Enable operator-only control methods such as server/restart")
+	readOnly := flag.Bool("read-only", false, "Reject all tools that modify files")
+	dryRun := flag.Bool("dry-run", false, "Have tools that modify files report what they would do without doing it")
+	enableTools := flag.String("enable-tools", "", "Comma-separated tools to offer; all others are hidden (default all)")
+	disableTools := flag.String("disable-tools", "", "Comma-separated tools to hide and refuse")
+	baseURL := flag.String("base-url", "", "Prefix for resource URIs in place of file://, e.g. mcpfs:// gives mcpfs://<root>/<path>")
+	toolTimeout := flag.Duration("tool-timeout", 0, "Longest a tool call may run before it fails, e.g. 30s (0 means no limit); calls can ask for less with timeout_seconds")
+	maxFileSize := flag.Int64("max-file-size", defaultMaxFileSize, "Largest file in bytes that read tools return whole; larger files must be read in ranges")
+	include := flag.String("include", "", "Comma-separated globs; only matching files are served")
+	exclude := flag.String("exclude", "", "Comma-separated globs of files or directories to hide; excludes win over includes")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Walk into symlinked directories inside the roots when listing resources, searching and scanning trees")
+	noFollowSymlinks := flag.Bool("no-follow-symlinks", false, "Refuse paths that go through symlinks, even ones that stay inside the served directory")
+	respectGitignore := flag.Bool("respect-gitignore", false, "Hide paths excluded by .gitignore files from resources/list and searches")
+	maxMessageSize := flag.Int("max-message-size", defaultMaxMessageSize, "Largest incoming JSON-RPC message in bytes; larger messages get an Invalid Request error")
+	framing := flag.String("framing", framingLine, "Framing for outgoing messages: line (newline-delimited JSON) or header (Content-Length)")
+	defaultLogLevel := os.Getenv("LOG_LEVEL")
+	if defaultLogLevel == "" {
+		defaultLogLevel = "info"
 	}
+	httpAddr := flag.String("http", "", "Serve over HTTP on this address instead of stdio (e.g. :8080, which listens on 127.0.0.1 only)")
+	listenAddr := flag.String("listen", "", "Serve newline-delimited JSON-RPC on a socket (tcp://host:port or unix:///path) instead of stdio")
+	maxSearchResults := flag.Int("max-search-results", defaultMaxResults, "Most matches search_files returns, and its default max_results")
+	maxConnections := flag.Int("max-connections", 0, "With -listen, stop after serving this many connections (0 means no limit)")
+	logLevelName := flag.String("log-level", defaultLogLevel, "Minimum log level: debug, info, warn or error (default from LOG_LEVEL)")
+	var rootArgs rootFlags
+	flag.Var(&rootArgs, "root", "Serve a directory under a name, as name=path (repeatable)")
+	mimeTypeArgs := make(mimeTypeFlags)
+	flag.Var(mimeTypeArgs, "mime-type", "Report files with an extension as a MIME type, as ext=type (repeatable)")
+	flag.Parse()
 
-	// Set up logging to stderr so it doesn't interfere with stdio communication
-	log.SetOutput(os.Stderr)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if *showVersion {
+		fmt.Printf("%s %s\n", serverName, serverVersion)
+		return
+	}
+
+	// Config file settings fill in every flag not given explicitly.
+	flagSettings := settings{
+		logLevel:     *logLevelName,
+		readOnly:     *readOnly,
+		maxFileSize:  *maxFileSize,
+		include:      *include,
+		exclude:      *exclude,
+		enableTools:  *enableTools,
+		disableTools: *disableTools,
+		mimeTypes:    mimeTypeArgs,
+	}
+	current := flagSettings
+	var cfg Config
+	setFlags := make(map[string]bool)
+	if *configPath != "" {
+		loaded, err := loadConfig(*configPath)
+		if err == nil {
+			err = loaded.validate(*createDir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -config %s: %v\n", *configPath, err)
+			os.Exit(2)
+		}
+		cfg = *loaded
+
+		flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		current = flagSettings.withConfig(&cfg, setFlags)
+	}
+
+	// Log JSON lines to stderr so logging never interferes with the protocol
+	// messages on stdout
+	level, err := parseLogLevel(current.logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -log-level: %v\n", err)
+		os.Exit(2)
+	}
+	logLevel.Set(level)
+	stderrHandler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(stderrHandler))
+
+	// -dir comes first, then named roots, then positional directories; the
+	// config file's roots apply only when none of those are given, and the
+	// current directory when nothing is
+	var roots []Root
+	if *dirFlag != "" {
+		roots = append(roots, Root{Dir: *dirFlag})
+	}
+	roots = append(roots, rootArgs...)
+	for _, dir := range flag.Args() {
+		roots = append(roots, Root{Dir: dir})
+	}
+	if len(roots) == 0 {
+		for _, root := range cfg.Roots {
+			roots = append(roots, Root{Name: root.Name, Dir: root.Path})
+		}
+	}
+	if len(roots) == 0 {
+		roots = []Root{{Dir: "."}}
+	}
+
+	names := make(map[string]bool)
+	for i := range roots {
+		root := &roots[i]
+
+		// Ensure the directory exists
+		if _, err := os.Stat(root.Dir); os.IsNotExist(err) {
+			if !*createDir {
+				fatal("Directory does not exist", "dir", root.Dir)
+			}
+			if err := os.MkdirAll(root.Dir, 0755); err != nil {
+				fatal("Failed to create directory", "dir", root.Dir, "error", err)
+			}
+		}
+
+		absDir, err := filepath.Abs(root.Dir)
+		if err != nil {
+			fatal("Invalid directory", "dir", root.Dir, "error", err)
+		}
+		root.Dir = absDir
+
+		// Unnamed roots are named after their directory, with a numeric
+		// suffix when two directories share a base name.
+		if root.Name == "" {
+			base := filepath.Base(absDir)
+			if base == string(filepath.Separator) || base == "." {
+				base = "root"
+			}
+			root.Name = base
+			for n := 2; names[root.Name]; n++ {
+				root.Name = fmt.Sprintf("%s-%d", base, n)
+			}
+		} else if names[root.Name] {
+			fatal("Duplicate root name", "root", root.Name)
+		}
+		names[root.Name] = true
+	}
+
+	server := NewMCPServer(roots)
+	slog.SetDefault(slog.New(&clientLogHandler{next: stderrHandler, server: server}))
+	server.requireDir = *requireDir
+	server.createDir = *createDir
+	server.allowControl = *allowControl
+	server.noStats = *noStats
+	server.dryRun = *dryRun
+	server.respectGitignore = *respectGitignore
+	server.noFollowSymlinks = *noFollowSymlinks
+	if *followSymlinks && *noFollowSymlinks {
+		fatal("-follow-symlinks and -no-follow-symlinks are mutually exclusive")
+	}
+	server.followSymlinks = *followSymlinks
 
-	server := NewMCPServer(baseDir)
-	if err := server.Run(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	if err := server.applySettings(current); err != nil {
+		fatal(err.Error())
+	}
+	if *configPath != "" {
+		server.configPath, err = filepath.Abs(*configPath)
+		if err != nil {
+			fatal("Invalid config path", "path", *configPath, "error", err)
+		}
+		server.flagSettings = flagSettings
+		server.setFlags = setFlags
+	}
+
+	if *toolTimeout < 0 {
+		fatal("Invalid -tool-timeout: must not be negative")
+	}
+	server.toolTimeout = *toolTimeout
+
+	if *baseURL != "" {
+		server.baseURL, err = parseBaseURL(*baseURL)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid -base-url: %v", err))
+		}
+	}
+
+	if *httpAddr != "" && *listenAddr != "" {
+		fatal("-http and -listen are mutually exclusive")
+	}
+	var listenNetwork, listenAddress string
+	if *listenAddr != "" {
+		listenNetwork, listenAddress, err = parseListenAddr(*listenAddr)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid -listen value %q: %v", *listenAddr, err))
+		}
+	}
+	if *maxConnections < 0 {
+		fatal(fmt.Sprintf("Invalid -max-connections %d: must not be negative", *maxConnections))
+	}
+
+	if *framing != framingLine && *framing != framingHeader {
+		fatal(fmt.Sprintf("Invalid -framing value %q: must be %s or %s", *framing, framingLine, framingHeader))
+	}
+	server.framing = *framing
+
+	if *maxMessageSize < 1024 {
+		fatal(fmt.Sprintf("Invalid -max-message-size %d: must be at least 1024 bytes", *maxMessageSize))
+	}
+	server.maxMessageSize = *maxMessageSize
+
+	if *maxSearchResults < 1 {
+		fatal(fmt.Sprintf("Invalid -max-search-results %d: must be positive", *maxSearchResults))
+	}
+	server.maxSearchResults = *maxSearchResults
+
+	if *auditLog != "" {
+		absAuditLog, err := filepath.Abs(*auditLog)
+		if err != nil {
+			fatal("Invalid audit log path", "path", *auditLog, "error", err)
+		}
+		server.auditLogPath = absAuditLog
+
+		if server.withinRoots(absAuditLog) {
+			slog.Warn("Audit log is inside the served directory; it will be hidden from clients", "path", absAuditLog)
+		}
+	}
+	// SIGINT and SIGTERM cancel ctx, which stops the transport and the
+	// background watchers before main returns.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch {
+	case *httpAddr != "":
+		err = server.RunHTTP(ctx, *httpAddr)
+	case listenNetwork != "":
+		err = server.RunListener(ctx, listenNetwork, listenAddress, *maxConnections)
+	default:
+		err = server.Run(ctx)
+	}
+	if err != nil {
+		fatal("Server error", "error", err)
 	}
+	slog.Info("Server stopped")
 }